@@ -30,11 +30,14 @@ func main() {
 		}
 	}
 
-	// choose first port
-	portnum := ifa[0].PortNum
+	// choose first port with link up
+	portnum, err := snf.DefaultPort()
+	if err != nil {
+		panic(err.Error())
+	}
 
 	// set SNF_NUM_RINGS, SNF_DATARING_SIZE in environment
-	dev, err := snf.OpenHandle(portnum(),
+	dev, err := snf.OpenHandle(portnum,
 		snf.HandlerOptRssFlags(snf.RssIP|snf.RssSrcPort|snf.RssDstPort),
 		snf.HandlerOptFlags(snf.PShared),
 	)
@@ -43,19 +46,13 @@ func main() {
 	}
 
 	// open rings until exhausted
-	var rings []*snf.Ring
-	for {
-		ring, err := dev.OpenRing()
-		if err == nil {
-			log.Println("opened ring #", len(rings), "on port #", portnum)
-			rings = append(rings, ring)
-			defer ring.Close()
-		} else if err == syscall.Errno(syscall.EBUSY) {
-			log.Println("unable to open more rings")
-			break
-		} else {
-			panic(err.Error())
-		}
+	rings, err := dev.OpenAllRings()
+	if err != nil {
+		panic(err.Error())
+	}
+	for i, ring := range rings {
+		log.Println("opened ring #", i, "on port #", portnum)
+		defer ring.Close()
 	}
 
 	var wg sync.WaitGroup
@@ -70,7 +67,7 @@ func main() {
 				200,              // size of packet bunch
 			)
 			defer rcv.Free()
-			ch := make(chan os.Signal)
+			ch := make(chan os.Signal, 1)
 			signal.Notify(ch, syscall.SIGINT, syscall.SIGUSR1)
 			rcv.NotifyWith(ch)
 			for j := 0; j < n; j++ {
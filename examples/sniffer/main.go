@@ -70,19 +70,13 @@ func main() {
 	}
 
 	// open rings until exhausted
-	var rings []*snf.Ring
-	for {
-		ring, err := dev.OpenRing()
-		if err == nil {
-			log.Println("opened ring #", len(rings), "on port #", portNum)
-			rings = append(rings, ring)
-			defer ring.Close()
-		} else if err == syscall.Errno(syscall.EBUSY) {
-			log.Println("unable to open more rings")
-			break
-		} else {
-			panic(err.Error())
-		}
+	rings, err := dev.OpenAllRings()
+	if err != nil {
+		panic(err.Error())
+	}
+	for i, ring := range rings {
+		log.Println("opened ring #", i, "on port #", portNum)
+		defer ring.Close()
 	}
 
 	var wg sync.WaitGroup
@@ -95,7 +89,7 @@ func main() {
 				200,              // size of packet bunch
 			)
 			defer rcv.Free()
-			ch := make(chan os.Signal)
+			ch := make(chan os.Signal, 1)
 			signal.Notify(ch, syscall.SIGINT, syscall.SIGUSR1)
 			rcv.NotifyWith(ch)
 
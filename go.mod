@@ -1,5 +1,5 @@
 module github.com/yerden/go-snf
 
-go 1.12
+go 1.17
 
 require github.com/google/gopacket v1.1.17
@@ -1,3 +1,4 @@
+//go:build snf_mockup
 // +build snf_mockup
 
 package snf
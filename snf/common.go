@@ -7,7 +7,8 @@
 package snf
 
 import (
-	"reflect"
+	"fmt"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -23,12 +24,8 @@ func retErr(x C.int) error {
 	return nil
 }
 
-func array2Slice(ptr uintptr, length int) (data []byte) {
-	sh := (*reflect.SliceHeader)(unsafe.Pointer(&data))
-	sh.Data = ptr
-	sh.Len = length
-	sh.Cap = length
-	return
+func array2Slice(ptr unsafe.Pointer, length int) []byte {
+	return unsafe.Slice((*byte)(ptr), length)
 }
 
 func intErr(out *C.struct_compound_int) (int, error) {
@@ -38,3 +35,30 @@ func intErr(out *C.struct_compound_int) (int, error) {
 func uint64Err(out *C.struct_compound_int) (uint64, error) {
 	return uint64(*(*C.ulong)(unsafe.Pointer(out))), retErr(out.rc)
 }
+
+type flagName struct {
+	flag int
+	name string
+}
+
+// flagsString renders flags as names joined with "|". Bits not
+// covered by names are rendered in hex.
+func flagsString(flags int, names []flagName) string {
+	if flags == 0 {
+		return "0"
+	}
+
+	var s []string
+	for _, n := range names {
+		if flags&n.flag == n.flag {
+			s = append(s, n.name)
+			flags &^= n.flag
+		}
+	}
+
+	if flags != 0 {
+		s = append(s, fmt.Sprintf("0x%x", flags))
+	}
+
+	return strings.Join(s, "|")
+}
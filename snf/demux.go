@@ -0,0 +1,75 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Demux splits packets retrieved by a RingReader, usually working on
+// an aggregated ring (see AggregatePortMask), into per-port streams.
+// Each packet is dispatched to the handler registered for the port it
+// arrived on according to RecvReq's PortNum().
+//
+// Handlers should be registered before Run() is called.
+type Demux struct {
+	rr       *RingReader
+	handlers []func(*RecvReq) error
+	def      func(*RecvReq) error
+}
+
+// NewDemux creates new Demux retrieving packets from rr.
+func NewDemux(rr *RingReader) *Demux {
+	return &Demux{rr: rr}
+}
+
+// Handle registers fn as a handler of packets arrived on the port
+// portnum. Previously registered handler of the port is replaced.
+//
+// The RecvReq passed to fn is subject to the same restrictions as
+// the one returned by RingReader's RecvReq().
+//
+// If portnum is negative or doesn't fit in a port mask, i.e. 32 or
+// greater, an error wrapping EINVAL is returned.
+func (d *Demux) Handle(portnum int, fn func(*RecvReq) error) error {
+	if portnum < 0 || portnum >= 32 {
+		return fmt.Errorf("invalid port number %d: %w", portnum, syscall.EINVAL)
+	}
+
+	if n := portnum + 1 - len(d.handlers); n > 0 {
+		d.handlers = append(d.handlers, make([]func(*RecvReq) error, n)...)
+	}
+	d.handlers[portnum] = fn
+	return nil
+}
+
+// HandleDefault registers fn as a handler of packets arrived on ports
+// with no handler registered. By default, such packets are skipped.
+func (d *Demux) HandleDefault(fn func(*RecvReq) error) {
+	d.def = fn
+}
+
+func (d *Demux) dispatch(req *RecvReq) error {
+	fn := d.def
+	if n := req.PortNum(); n < len(d.handlers) && d.handlers[n] != nil {
+		fn = d.handlers[n]
+	}
+
+	if fn == nil {
+		return nil
+	}
+	return fn(req)
+}
+
+// Run retrieves packets with RingReader's ForEach() and dispatches
+// them to the registered handlers. If a handler returns non-nil
+// error, Run stops and returns the error. Otherwise, it runs until
+// the RingReader stops in which case RingReader's Err() is returned.
+func (d *Demux) Run() error {
+	return d.rr.ForEach(d.dispatch)
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+// OpenDuplex opens the port for capture with OpenHandle() and the
+// given options and then opens it for injection with
+// OpenInjectHandle(), e.g. for a bump-in-the-wire application which
+// captures packets and reinjects them on the same physical port.
+// Capture and injection may coexist on the same port: capture mode
+// switches the port's receive path from the Ethernet driver to the
+// Sniffer while injection handles are independent of it.
+//
+// If the injection handle can't be opened, the capture Handle is
+// closed and the error is returned.
+//
+// Use CloseDuplex() to close both handles.
+func OpenDuplex(portnum uint32, options ...HandlerOption) (*Handle, *InjectHandle, error) {
+	h, err := OpenHandle(portnum, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inj, err := OpenInjectHandle(int(portnum))
+	if err != nil {
+		h.Close()
+		return nil, nil, err
+	}
+
+	return h, inj, nil
+}
+
+// CloseDuplex closes the handles opened with OpenDuplex(). The
+// injection handle is closed first, ensuring that all pending sends
+// are sent, and then all rings opened on the capture Handle and the
+// Handle itself are closed with CloseAll(). The first encountered
+// error is returned.
+func CloseDuplex(h *Handle, inj *InjectHandle) error {
+	err := inj.Close()
+	if e := h.CloseAll(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+// SetRecvReqData makes req describe a packet of length bytes
+// occupying data as its data ring slot.
+func SetRecvReqData(req *RecvReq, data []byte, length int) {
+	req.setData(data, length)
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+/*
+#include "wrapper.h"
+*/
+import "C"
+
+import (
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Reader is the minimal interface to retrieve packets. It is
+// implemented by RingReader and FileRing so packet processing logic
+// may be tested without SNF-capable hardware.
+type Reader interface {
+	// Next retrieves next packet. If false, Err() should be
+	// examined.
+	Next() bool
+	// RecvReq returns current packet descriptor.
+	RecvReq() *RecvReq
+	// Data returns current packet's data.
+	Data() []byte
+	// Err returns the error encountered by Next().
+	Err() error
+}
+
+var _ Reader = (*RingReader)(nil)
+var _ Reader = (*FileRing)(nil)
+
+// FileRing reads packets from a pcap or pcapng file and exposes them
+// as RecvReq packet descriptors, similar to RingReader. Packets
+// timestamps and interface indices recorded in the file are
+// preserved in RecvReq and gopacket.CaptureInfo.
+//
+// FileRing is intended for testing purposes.
+type FileRing struct {
+	r    io.ReadSeeker
+	src  gopacket.PacketDataSource
+	loop bool
+
+	// number of packets read from the current pass over the file
+	count int
+
+	req  RecvReq
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+// NewFileRing creates new FileRing reading packets from r which
+// should contain pcap or pcapng file. If loop is true, FileRing
+// starts over from the beginning of the file once all packets are
+// read, which is useful for soak testing.
+func NewFileRing(r io.ReadSeeker, loop bool) (*FileRing, error) {
+	fr := &FileRing{r: r, loop: loop}
+	return fr, fr.rewind()
+}
+
+func (fr *FileRing) rewind() error {
+	if _, err := fr.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if src, err := pcapgo.NewReader(fr.r); err == nil {
+		fr.src = src
+		return nil
+	}
+
+	if _, err := fr.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	src, err := pcapgo.NewNgReader(fr.r, pcapgo.DefaultNgReaderOptions)
+	if err == nil {
+		fr.src = src
+	}
+	return err
+}
+
+// Next reads next packet from the file. If true, the operation is a
+// success, otherwise Err() should be examined. io.EOF is returned if
+// there are no more packets in the file and looping is disabled, or
+// the file contains no packets.
+func (fr *FileRing) Next() bool {
+	for {
+		fr.data, fr.ci, fr.err = fr.src.ReadPacketData()
+		if fr.err == nil && len(fr.data) > 0 {
+			break
+		} else if fr.err == nil {
+			// skip empty packets
+			continue
+		} else if fr.err != io.EOF || !fr.loop || fr.count == 0 {
+			return false
+		}
+
+		if fr.err = fr.rewind(); fr.err != nil {
+			return false
+		}
+		fr.count = 0
+	}
+
+	fr.count++
+	fr.req.setData(fr.data, len(fr.data))
+	fr.req.timestamp = C.uint64_t(fr.ci.Timestamp.UnixNano())
+	fr.req.portnum = C.uint32_t(fr.ci.InterfaceIndex)
+	fr.req.hw_hash = 0
+	return true
+}
+
+// LoopNext is the same as Next since reading from file never
+// returns EAGAIN.
+func (fr *FileRing) LoopNext() bool {
+	return fr.Next()
+}
+
+// RecvReq returns current packet descriptor. The descriptor and the
+// data it points to are valid until the next call to Next().
+func (fr *FileRing) RecvReq() *RecvReq {
+	return &fr.req
+}
+
+// Data returns current packet's data. The data is valid until the
+// next call to Next().
+func (fr *FileRing) Data() []byte {
+	return fr.data
+}
+
+// Err returns error which was encountered during the last Next()
+// call.
+func (fr *FileRing) Err() error {
+	return fr.err
+}
+
+// ZeroCopyReadPacketData implements gopacket.ZeroCopyPacketDataSource.
+func (fr *FileRing) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if !fr.Next() {
+		err = fr.Err()
+	} else {
+		data, ci = fr.data, fr.ci
+	}
+
+	return
+}
+
+// ReadPacketData implements gopacket.PacketDataSource.
+func (fr *FileRing) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if data, ci, err = fr.ZeroCopyReadPacketData(); err == nil {
+		data = append(make([]byte, 0, len(data)), data...)
+	}
+	return
+}
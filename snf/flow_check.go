@@ -0,0 +1,124 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Flow is a network and transport flow of a packet, e.g. IP
+// addresses and TCP/UDP ports.
+type Flow struct {
+	Network   gopacket.Flow
+	Transport gopacket.Flow
+}
+
+// SplitFlow is a flow delivered to more than one ring.
+type SplitFlow struct {
+	Flow Flow
+	// Rings are indices of the rings the flow was delivered to.
+	Rings []int
+}
+
+// FlowChecker verifies that packets of each flow are consistently
+// delivered to a single ring as expected with RSS. It is intended for
+// diagnosing RSS misconfiguration which breaks stateful processing.
+//
+// FlowChecker is safe for concurrent use so packets may be added from
+// goroutines receiving packets from different rings.
+type FlowChecker struct {
+	mtx   sync.Mutex
+	flows map[Flow][]int
+}
+
+// NewFlowChecker returns new FlowChecker.
+func NewFlowChecker() *FlowChecker {
+	return &FlowChecker{flows: make(map[Flow][]int)}
+}
+
+// Add decodes Ethernet frame data and records its flow as delivered
+// to the ring with the given index. Packets without network layer are
+// ignored.
+func (fc *FlowChecker) Add(ring int, data []byte) {
+	p := gopacket.NewPacket(data, layers.LinkTypeEthernet,
+		gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	nl := p.NetworkLayer()
+	if nl == nil {
+		return
+	}
+
+	flow := Flow{Network: nl.NetworkFlow()}
+	if tl := p.TransportLayer(); tl != nil {
+		flow.Transport = tl.TransportFlow()
+	}
+
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	rings := fc.flows[flow]
+	for _, r := range rings {
+		if r == ring {
+			return
+		}
+	}
+	fc.flows[flow] = append(rings, ring)
+}
+
+// Split returns flows which were delivered to more than one ring.
+func (fc *FlowChecker) Split() (split []SplitFlow) {
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	for flow, rings := range fc.flows {
+		if len(rings) > 1 {
+			split = append(split, SplitFlow{flow, append([]int(nil), rings...)})
+		}
+	}
+	return split
+}
+
+// CheckFlows receives packets from the rings for the duration of
+// window and returns flows which were delivered to more than one
+// ring. The indices of the rings in SplitFlow refer to rings. Packet
+// capture should be started on the Handle beforehand.
+//
+// The first error encountered while receiving is returned.
+func CheckFlows(rings []*Ring, window time.Duration) ([]SplitFlow, error) {
+	fc := NewFlowChecker()
+	deadline := time.Now().Add(window)
+	errs := make([]error, len(rings))
+
+	var wg sync.WaitGroup
+	for i, r := range rings {
+		wg.Add(1)
+		go func(i int, r *Ring) {
+			defer wg.Done()
+			rr := NewReader(r, 10*time.Millisecond, 256)
+			defer rr.Free()
+			for time.Now().Before(deadline) {
+				if rr.Next() {
+					fc.Add(i, rr.Data())
+				} else if err := rr.Err(); err != syscall.EAGAIN {
+					errs[i] = err
+					return
+				}
+			}
+		}(i, r)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fc.Split(), nil
+}
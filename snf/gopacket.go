@@ -8,9 +8,12 @@ package snf
 
 import (
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"time"
 )
 
+// struct snf_recv_req has no wire length, so Length is the captured
+// length
 func reqDataCi(req *RecvReq) (data []byte, ci gopacket.CaptureInfo) {
 	data = req.Data()
 	return data, gopacket.CaptureInfo{
@@ -23,29 +26,165 @@ func reqDataCi(req *RecvReq) (data []byte, ci gopacket.CaptureInfo) {
 
 // CaptureInfo returns gopacket.CaptureInfo metadata for retrieved
 // packet.
+//
+// SNF doesn't report the original length of the packet on the wire
+// separately from the captured length, so Length and CaptureLength are
+// always equal here. RingReader truncating packets with
+// ReaderOptSnapLen option reports CaptureLength less than Length.
 func (req *RecvReq) CaptureInfo() (ci gopacket.CaptureInfo) {
 	_, ci = reqDataCi(req)
 	return
 }
 
+func newPacket(data []byte, ci gopacket.CaptureInfo,
+	dec gopacket.Decoder, opts gopacket.DecodeOptions) gopacket.Packet {
+	p := gopacket.NewPacket(data, dec, opts)
+	m := p.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	return p
+}
+
+// DecodePacket decodes the packet with dec and opts and returns
+// gopacket.Packet with CaptureInfo metadata filled in.
+//
+// If opts.NoCopy is true, the packet refers directly to the data ring
+// so it may not be retained after the descriptor is reused (see
+// Data()).
+func (req *RecvReq) DecodePacket(dec gopacket.Decoder, opts gopacket.DecodeOptions) gopacket.Packet {
+	data, ci := reqDataCi(req)
+	return newPacket(data, ci, dec, opts)
+}
+
+// CapturedPacket is a snapshot of a received packet. Unlike RecvReq,
+// it holds its own copy of the packet data and thus may be retained
+// after the next packet is received.
+type CapturedPacket struct {
+	// Data is a copy of the packet's payload.
+	Data []byte
+	// CaptureInfo is the packet's metadata.
+	CaptureInfo gopacket.CaptureInfo
+	// HwHash is the hash calculated by the NIC.
+	HwHash uint32
+}
+
+// Copy returns a snapshot of the packet data along with its metadata.
+// The returned CapturedPacket is safe to retain after the next packet
+// is received.
+func (req *RecvReq) Copy() CapturedPacket {
+	data, ci := reqDataCi(req)
+	return CapturedPacket{
+		Data:        append(make([]byte, 0, len(data)), data...),
+		CaptureInfo: ci,
+		HwHash:      req.HwHash(),
+	}
+}
+
+// copy of the current packet of the RingReader, snap length applied
+func (rr *RingReader) capture() CapturedPacket {
+	req := rr.req()
+	data, ci := reqDataCi(req)
+	data = rr.snap(data)
+	ci.CaptureLength = len(data)
+	return CapturedPacket{
+		Data:        append(make([]byte, 0, len(data)), data...),
+		CaptureInfo: ci,
+		HwHash:      req.HwHash(),
+	}
+}
+
+// LinkType returns the link type of packets captured on the port.
+// SNF only supports Ethernet media so it is always
+// layers.LinkTypeEthernet.
+func (h *Handle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// LinkType returns the link type of packets retrieved by RingReader.
+// See Handle's LinkType() method.
+func (rr *RingReader) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
 var _ gopacket.ZeroCopyPacketDataSource = (*RingReader)(nil)
 var _ gopacket.PacketDataSource = (*RingReader)(nil)
 
 // ZeroCopyReadPacketData implements gopacket.ZeroCopyPacketDataSource.
+//
+// The returned data refers directly to the data ring and CaptureInfo
+// is returned by value so the call doesn't allocate. The data may not
+// be retained past the next call.
 func (rr *RingReader) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
 	if !rr.Next() {
 		err = rr.Err()
 	} else {
 		data, ci = reqDataCi(rr.req())
+		data = rr.snap(data)
+		ci.CaptureLength = len(data)
 	}
 
 	return
 }
 
+// NextPacket retrieves next packet with Next() and decodes it
+// according to LinkType() with Lazy and NoCopy decoding options. The
+// packet may not be retained past the next Next() call.
+//
+// If no packet could be retrieved, nil is returned and Err() should
+// be examined.
+func (rr *RingReader) NextPacket() gopacket.Packet {
+	data, ci, err := rr.ZeroCopyReadPacketData()
+	if err != nil {
+		return nil
+	}
+	return newPacket(data, ci, rr.LinkType(),
+		gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+}
+
 // ReadPacketData implements gopacket.PacketDataSource.
+//
+// The packet data is copied into a newly allocated slice so it may be
+// retained by the caller. This costs one allocation and a copy of the
+// packet per call; use ZeroCopyReadPacketData() if this is an issue.
 func (rr *RingReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
 	if data, ci, err = rr.ZeroCopyReadPacketData(); err == nil {
 		data = append(make([]byte, 0, len(data)), data...)
 	}
 	return
 }
+
+// NewPacketSource returns gopacket.PacketSource reading packets from
+// the RingReader and decoding them according to LinkType().
+//
+// The source is configured with Lazy and NoCopy decoding options so
+// packets and their layers refer directly to the data ring. As with
+// Data(), such packets may not be retained past the next Next() call
+// (or the next packet retrieved from the source). Set the source's
+// DecodeOptions.NoCopy to false if you need to keep them longer.
+func (rr *RingReader) NewPacketSource() *gopacket.PacketSource {
+	src := gopacket.NewPacketSource(rr, rr.LinkType())
+	src.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	return src
+}
+
+// SendPacket injects the data of the gopacket.Packet p with Send().
+// See Send() for details.
+func (s *Sender) SendPacket(p gopacket.Packet) error {
+	return s.Send(p.Data())
+}
+
+// SchedPacket injects the data of the gopacket.Packet p with
+// SchedAfter(). See SchedAfter() for details.
+func (s *Sender) SchedPacket(delay time.Duration, p gopacket.Packet) error {
+	return s.SchedAfter(delay, p.Data())
+}
+
+// SendPacket is the same as Sender's SendPacket().
+func (ss *SyncSender) SendPacket(p gopacket.Packet) error {
+	return ss.Send(p.Data())
+}
+
+// SchedPacket is the same as Sender's SchedPacket().
+func (ss *SyncSender) SchedPacket(delay time.Duration, p gopacket.Packet) error {
+	return ss.SchedAfter(delay, p.Data())
+}
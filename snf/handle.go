@@ -6,11 +6,69 @@ package snf
 import "C"
 
 import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
 // Handle encapsulates a device handle.
-type Handle C.struct_snf_handle
+type Handle struct {
+	dev C.snf_handle_t
+
+	// rings opened on this handle
+	mtx   sync.Mutex
+	rings []*Ring
+
+	// serializes Close(); closed is 1 once the handle is closed
+	closeMtx sync.Mutex
+	closed   uint32
+
+	// serializes Start() and Stop(); started is 1 if capture is
+	// started
+	startMtx sync.Mutex
+	started  uint32
+
+	// drop counters for DropsSinceStart() since the last Start(),
+	// guarded by startMtx; NIC counters are per port and tracked
+	// once, ring counters are tracked per ring including closed
+	// ones
+	dropsStarted bool
+	nicDrops     *dropCounter
+	ringDrops    map[*Ring]*dropCounter
+}
+
+// dropCounter tracks a drop counter relative to its baseline.
+type dropCounter struct {
+	base  uint64
+	last  uint64
+	accum uint64
+}
+
+func newDropCounter(n uint64) *dropCounter {
+	return &dropCounter{base: n, last: n}
+}
+
+// update records the current value of the counter. If the counter
+// decreased, it was reset so the drops counted so far are preserved
+// and the baseline is recaptured from zero. true is returned in that
+// case.
+func (c *dropCounter) update(n uint64) (reset bool) {
+	if reset = n < c.last; reset {
+		c.accum += c.last - c.base
+		c.base = 0
+	}
+	c.last = n
+	return
+}
+
+func (c *dropCounter) value() uint64 {
+	return c.accum + c.last - c.base
+}
 
 // snf_open() options container
 type handlerOpts struct {
@@ -18,8 +76,15 @@ type handlerOpts struct {
 	rss          *C.struct_snf_rss_params
 	flags        C.int
 	dataRingSize C.long
+	appID        *int32
+
+	// error encountered while applying options
+	err error
 }
 
+// serializes setting application ID and opening a handle
+var openMtx sync.Mutex
+
 // HandlerOption specifies an option for opening a Handle.
 type HandlerOption struct {
 	f func(*handlerOpts)
@@ -74,9 +139,146 @@ func OpenHandle(portnum uint32, options ...HandlerOption) (*Handle, error) {
 		opt.f(opts)
 	}
 
+	if opts.err != nil {
+		return nil, opts.err
+	}
+
+	openMtx.Lock()
+	defer openMtx.Unlock()
+
+	if opts.appID != nil {
+		if err := setAppID(*opts.appID); err != nil {
+			return nil, err
+		}
+	}
+
 	rc := C.snf_open(C.uint(portnum), opts.numRings, opts.rss,
 		opts.dataRingSize, opts.flags, &dev)
-	return (*Handle)(unsafe.Pointer(dev)), retErr(rc)
+	if err := retErr(rc); err != nil {
+		return nil, err
+	}
+	return &Handle{dev: dev}, nil
+}
+
+// OpenHandleWait is the same as OpenHandle but it retries opening the
+// port while EBUSY is returned, e.g. if the port is not yet released
+// by another process, until timeout expires. The delay between
+// attempts starts with 10ms and is doubled up to 1s. If the port
+// can't be opened in time, the last error is returned.
+func OpenHandleWait(portnum uint32, timeout time.Duration, options ...HandlerOption) (*Handle, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := 10 * time.Millisecond
+	for {
+		h, err := OpenHandle(portnum, options...)
+		if err != syscall.EBUSY {
+			return h, err
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, err
+		} else if backoff > left {
+			backoff = left
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
+
+// OpenHandleByName is the same as OpenHandle but the port is looked
+// up by the interface name with GetIfAddrByName(). If there is no
+// such port, an error wrapping ENODEV is returned.
+func OpenHandleByName(name string, options ...HandlerOption) (*Handle, error) {
+	ifa, err := GetIfAddrByName(name)
+	if err == syscall.ENODEV {
+		return nil, fmt.Errorf("no SNF port named %s: %w", name, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return OpenHandle(ifa.PortNum(), options...)
+}
+
+// OpenHandleByHW is the same as OpenHandle but the port is looked up
+// by the MAC address with GetIfAddrByHW(). If there is no such port,
+// an error wrapping ENODEV is returned.
+func OpenHandleByHW(addr net.HardwareAddr, options ...HandlerOption) (*Handle, error) {
+	ifa, err := GetIfAddrByHW(addr)
+	if err == syscall.ENODEV {
+		return nil, fmt.Errorf("no SNF port with address %v: %w", addr, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return OpenHandle(ifa.PortNum(), options...)
+}
+
+// OpenDefaultHandle is the same as OpenHandle but the port is chosen
+// with DefaultPort().
+func OpenDefaultHandle(options ...HandlerOption) (*Handle, error) {
+	portnum, err := DefaultPort()
+	if err != nil {
+		return nil, err
+	}
+	return OpenHandle(portnum, options...)
+}
+
+// OpenAggregate opens the specified ports as a single Handle
+// merging the incoming data from all of them. The port mask is built
+// with PortMaskOf() and AggregatePortMask flag is added to the flags
+// specified in options.
+//
+// Every port is checked against the valid mask returned by PortMask().
+// If some port is not valid, an error wrapping ENODEV is returned.
+// EINVAL is returned if no ports are specified.
+func OpenAggregate(ports []uint32, options ...HandlerOption) (*Handle, error) {
+	if len(ports) == 0 {
+		return nil, syscall.EINVAL
+	}
+
+	_, valid, err := PortMask()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range ports {
+		if p >= 32 || valid&(1<<p) == 0 {
+			return nil, fmt.Errorf("SNF port %d is not valid: %w", p, syscall.ENODEV)
+		}
+	}
+
+	options = append(options[:len(options):len(options)],
+		HandlerOptFlags(AggregatePortMask))
+	return OpenHandle(PortMaskOf(ports...), options...)
+}
+
+// OpenAllPorts opens all valid Sniffer-capable ports as a single
+// Handle merging the incoming data from all of them. The special
+// portnum -1 is used so the library opens the valid mask as returned
+// by PortMask(). AggregatePortMask flag is added to the flags
+// specified in options.
+func OpenAllPorts(options ...HandlerOption) (*Handle, error) {
+	options = append(options[:len(options):len(options)],
+		HandlerOptFlags(AggregatePortMask))
+	return OpenHandle(^uint32(0), options...)
+}
+
+// HandlerOptAppID specifies application ID to set with SetAppID()
+// right before opening a Handle. Setting the ID and opening the
+// Handle is serialized with other OpenHandle() calls so handles with
+// distinct application IDs may be opened concurrently.
+//
+// The application ID is process-wide and SNF provides no way to unset
+// it, so the ID stays in effect for subsequent OpenHandle() calls
+// made without this option, exactly as if SetAppID() was called.
+//
+// Please note that if SNF_APP_ID environment variable is set, it
+// overrides the ID specified with this option.
+func HandlerOptAppID(id int32) HandlerOption {
+	return HandlerOption{func(opts *handlerOpts) {
+		opts.appID = &id
+	}}
 }
 
 // HandlerOptNumRings specifies number of rings to allocate for
@@ -98,16 +300,61 @@ func HandlerOptNumRings(n int) HandlerOption {
 // less than 1048576) or is otherwise considered to be in bytes.  In
 // either case, the library may slightly adjust the user's request to
 // satisfy alignment requirements (typically 2MB boundaries).
+//
+// Please note that e.g. 1000000 is interpreted as megabytes. Use
+// HandlerOptDataRingMB or HandlerOptDataRingBytes options to specify
+// the units explicitly.
 func HandlerOptDataRingSize(n int64) HandlerOption {
 	return HandlerOption{func(opts *handlerOpts) {
 		opts.dataRingSize = C.long(n)
 	}}
 }
 
+// Data ring size limits for HandlerOptDataRingMB and
+// HandlerOptDataRingBytes options. Sizes less than 1MB can't be
+// specified in bytes since SNF interprets them as megabytes.
+const (
+	MinDataRingBytes = 1 << 20
+	MaxDataRingBytes = 1<<40 - 1
+)
+
+// HandlerOptDataRingMB specifies the total amount of memory in
+// megabytes to be used to store incoming packet data for *all* rings
+// to be opened. See HandlerOptDataRingSize for details.
+//
+// If mb is not positive or exceeds MaxDataRingBytes, OpenHandle
+// returns an error wrapping EINVAL.
+func HandlerOptDataRingMB(mb int) HandlerOption {
+	return HandlerOption{func(opts *handlerOpts) {
+		if mb <= 0 || int64(mb) > MaxDataRingBytes>>20 {
+			opts.err = fmt.Errorf("invalid data ring size %d MB: %w", mb, syscall.EINVAL)
+			return
+		}
+		opts.dataRingSize = C.long(mb)
+	}}
+}
+
+// HandlerOptDataRingBytes specifies the total amount of memory in
+// bytes to be used to store incoming packet data for *all* rings to
+// be opened. See HandlerOptDataRingSize for details.
+//
+// If n is less than MinDataRingBytes or larger than
+// MaxDataRingBytes, OpenHandle returns an error wrapping EINVAL.
+func HandlerOptDataRingBytes(n int64) HandlerOption {
+	return HandlerOption{func(opts *handlerOpts) {
+		if n < MinDataRingBytes || n > MaxDataRingBytes {
+			opts.err = fmt.Errorf("invalid data ring size %d bytes: %w", n, syscall.EINVAL)
+			return
+		}
+		opts.dataRingSize = C.long(n)
+	}}
+}
+
 // HandlerOptFlags specifies a mask of flags documented in SNF API
 // Reference.  You may specify a number of flags. They will be OR'ed
-// before applying to the Handle.
-func HandlerOptFlags(flags int) HandlerOption {
+// before applying to the Handle. If flags is negative, default flags
+// are used which may be set in SNF_FLAGS environment variable.
+func HandlerOptFlags(flags Flag) HandlerOption {
 	return HandlerOption{func(opts *handlerOpts) {
 		if flags < 0 {
 			opts.flags = -1
@@ -125,7 +372,7 @@ func HandlerOptFlags(flags int) HandlerOption {
 // if there are more than 1 rings to be opened.
 //
 // Note that this option unsets HandlerOptRssFunc option.
-func HandlerOptRssFlags(flags int) HandlerOption {
+func HandlerOptRssFlags(flags RSSFlag) HandlerOption {
 	return HandlerOption{func(opts *handlerOpts) {
 		if opts.rss == nil {
 			opts.rss = &C.struct_snf_rss_params{}
@@ -169,7 +416,36 @@ func HandlerOptRssFunc(fn *CHashFunc, ctx unsafe.Pointer) HandlerOption {
 }
 
 func handle(h *Handle) C.snf_handle_t {
-	return C.snf_handle_t(unsafe.Pointer(h))
+	return h.dev
+}
+
+func (h *Handle) addRing(r *Ring) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.rings = append(h.rings, r)
+}
+
+func (h *Handle) removeRing(r *Ring) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i := range h.rings {
+		if h.rings[i] == r {
+			h.rings = append(h.rings[:i], h.rings[i+1:]...)
+			break
+		}
+	}
+}
+
+// Rings returns rings opened on the handle with OpenRing() or
+// OpenRingID() and not yet closed. The returned slice is a snapshot
+// and is not affected by subsequent opening or closing of rings.
+//
+// It is safe to call this method concurrently with opening and
+// closing rings.
+func (h *Handle) Rings() []*Ring {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return append([]*Ring(nil), h.rings...)
 }
 
 // LinkState gets link status on opened handle.
@@ -202,8 +478,109 @@ func (h *Handle) LinkSpeed() (uint64, error) {
 // It is safe to restart packet capture via Start() and Stop()
 // methods.  This call must be called before any packet can be
 // received.
+//
+// If packet capture was already started with Start(), the call is
+// a no-op and nil is returned.
 func (h *Handle) Start() error {
-	return retErr(C.snf_start(handle(h)))
+	h.startMtx.Lock()
+	defer h.startMtx.Unlock()
+	if h.IsStarted() {
+		return nil
+	}
+
+	err := retErr(C.snf_start(handle(h)))
+	if err == nil {
+		atomic.StoreUint32(&h.started, 1)
+		h.snapshotDrops()
+	}
+	return err
+}
+
+// snapshotDrops captures the baseline of drop counters of all opened
+// rings. Rings failing to report statistics and rings opened later
+// are counted from zero. Must be called with startMtx held.
+func (h *Handle) snapshotDrops() {
+	h.dropsStarted = true
+	h.nicDrops = nil
+	h.ringDrops = make(map[*Ring]*dropCounter)
+	for _, r := range h.Rings() {
+		stats, err := r.Stats()
+		if err != nil {
+			continue
+		}
+		if h.nicDrops == nil {
+			h.nicDrops = newDropCounter(stats.NicPktOverflow)
+		}
+		h.ringDrops[r] = newDropCounter(stats.RingPktOverflow + stats.SnfPktOverflow)
+	}
+}
+
+// DropsSinceStart returns number of packets dropped since the last
+// successful Start() call. Packets dropped due to insufficient space
+// in the rings and shared SNF buffering are counted per ring over all
+// rings opened on the Handle, including the rings closed since then
+// with their drops as of the last call. Packets dropped by the NIC
+// are counted once since the counter is per port and shared by all
+// rings.
+//
+// Statistics are only available from the rings so the baselines are
+// captured at Start() from the rings opened at the moment. If no ring
+// reported statistics at Start(), the baseline of the NIC counter is
+// captured on the first call instead and packets dropped by the NIC
+// in between are not counted. Rings opened after Start() are counted
+// from zero. Open the rings before Start() for accurate results.
+//
+// If a counter was cleared administratively since the previous call,
+// the drops counted before the reset are preserved, the baseline is
+// recaptured from zero and the discontinuity is logged.
+//
+// EINVAL is returned if Start() was never called.
+func (h *Handle) DropsSinceStart() (uint64, error) {
+	h.startMtx.Lock()
+	defer h.startMtx.Unlock()
+	if !h.dropsStarted {
+		return 0, fmt.Errorf("capture was never started: %w", syscall.EINVAL)
+	}
+
+	for _, r := range h.Rings() {
+		stats, err := r.Stats()
+		if err != nil {
+			return 0, err
+		}
+
+		nic := stats.NicPktOverflow
+		if h.nicDrops == nil {
+			h.nicDrops = newDropCounter(nic)
+		} else if h.nicDrops.update(nic) {
+			log.Printf("snf: NIC drop counter was reset, baseline recaptured")
+		}
+
+		drops := stats.RingPktOverflow + stats.SnfPktOverflow
+		if c, ok := h.ringDrops[r]; !ok {
+			// opened after Start()
+			h.ringDrops[r] = &dropCounter{last: drops}
+		} else if c.update(drops) {
+			log.Printf("snf: drop counters of ring %p were reset, baseline recaptured", r)
+		}
+	}
+
+	var total uint64
+	if h.nicDrops != nil {
+		total += h.nicDrops.value()
+	}
+	for _, c := range h.ringDrops {
+		total += c.value()
+	}
+	return total, nil
+}
+
+// IsStarted returns true if packet capture was started with Start()
+// and not stopped since then with Stop() or Close().
+//
+// Please note that the state is maintained by the Handle and doesn't
+// reflect Stop() performed by other processes sharing the port.
+func (h *Handle) IsStarted() bool {
+	return atomic.LoadUint32(&h.started) > 0
 }
 
 // Stop packet capture on a port.  This function should be used
@@ -214,8 +591,21 @@ func (h *Handle) Start() error {
 // Stop instructs the NIC to drop all packets until the next Start()
 // or until the port is closed.  The NIC only resumes delivering
 // packets when the port is closed, not when traffic is stopped.
+//
+// If packet capture is not started with Start(), the call is a no-op
+// and nil is returned.
 func (h *Handle) Stop() error {
-	return retErr(C.snf_stop(handle(h)))
+	h.startMtx.Lock()
+	defer h.startMtx.Unlock()
+	if !h.IsStarted() {
+		return nil
+	}
+
+	err := retErr(C.snf_stop(handle(h)))
+	if err == nil {
+		atomic.StoreUint32(&h.started, 0)
+	}
+	return err
 }
 
 // Close port.
@@ -231,9 +621,48 @@ func (h *Handle) Stop() error {
 // If successful, all resources allocated at open time are unallocated
 // and the device switches from Sniffer mode to Ethernet mode such
 // that the Ethernet driver resumes receiving packets.
+//
+// Reflect handles enabled on the handle with ReflectEnable() are
+// closed as well.
+//
+// Subsequent calls to Close return nil.
 func (h *Handle) Close() (err error) {
+	h.closeMtx.Lock()
+	defer h.closeMtx.Unlock()
+	if h.isClosed() {
+		return nil
+	}
 	// if EBUSY, you should close other rings
-	return retErr(C.snf_close(handle(h)))
+	if err = retErr(C.snf_close(handle(h))); err == nil {
+		atomic.StoreUint32(&h.started, 0)
+		atomic.StoreUint32(&h.closed, 1)
+	}
+	return err
+}
+
+func (h *Handle) isClosed() bool {
+	return atomic.LoadUint32(&h.closed) > 0
+}
+
+// CloseAll closes all rings opened on the handle and then closes the
+// handle itself.
+//
+// All rings are attempted to be closed even if some of them fail. In
+// that case the first encountered error is returned and the handle is
+// left open.
+func (h *Handle) CloseAll() error {
+	var err error
+	for _, r := range h.Rings() {
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return h.Close()
 }
 
 // OpenRing opens the next available ring.
@@ -281,8 +710,55 @@ func (h *Handle) OpenRing() (ring *Ring, err error) {
 // Sniffer-mode NIC to deliver packets to the host.
 func (h *Handle) OpenRingID(id int) (ring *Ring, err error) {
 	var r C.snf_ring_t
-	rc := C.snf_ring_open_id(handle(h), C.int(id), &r)
-	return (*Ring)(unsafe.Pointer(r)), retErr(rc)
+	if err := retErr(C.snf_ring_open_id(handle(h), C.int(id), &r)); err != nil {
+		return nil, err
+	}
+
+	ring = &Ring{ringh: r, h: h}
+	h.addRing(ring)
+	return ring, nil
+}
+
+// OpenRings opens exactly n rings with OpenRing() method.
+//
+// If any of the rings can't be opened, all rings opened so far are
+// closed and the error is returned.
+func (h *Handle) OpenRings(n int) ([]*Ring, error) {
+	rings := make([]*Ring, 0, n)
+	for len(rings) < n {
+		r, err := h.OpenRing()
+		if err != nil {
+			closeRings(rings)
+			return nil, err
+		}
+		rings = append(rings, r)
+	}
+	return rings, nil
+}
+
+// OpenAllRings opens rings with OpenRing() method until EBUSY is
+// returned, i.e. there are no more rings available, and returns them.
+//
+// If any error other than EBUSY is encountered, all rings opened so
+// far are closed and the error is returned.
+func (h *Handle) OpenAllRings() ([]*Ring, error) {
+	var rings []*Ring
+	for {
+		r, err := h.OpenRing()
+		if err == syscall.EBUSY {
+			return rings, nil
+		} else if err != nil {
+			closeRings(rings)
+			return nil, err
+		}
+		rings = append(rings, r)
+	}
+}
+
+func closeRings(rings []*Ring) {
+	for _, r := range rings {
+		r.Close()
+	}
 }
 
 // TimeSourceState returns timesource information from opened handle
@@ -135,3 +135,33 @@ func PortMask() (linkup, valid uint32, err error) {
 	}
 	return linkup, valid, err
 }
+
+// DefaultPort returns the lowest-numbered Sniffer-capable port which
+// has its link state set to UP. If there is no such port, an error
+// wrapping ENODEV is returned.
+func DefaultPort() (uint32, error) {
+	linkup, _, err := PortMask()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := uint32(0); i < 32; i++ {
+		if linkup&(1<<i) != 0 {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no SNF port with link up: %w", syscall.ENODEV)
+}
+
+// PortMaskOf returns a mask of specified port numbers suitable for
+// opening a Handle with AggregatePortMask flag. The least significant
+// bit represents port 0. Port numbers beyond 31 are ignored.
+func PortMaskOf(ports ...uint32) (mask uint32) {
+	for _, p := range ports {
+		if p < 32 {
+			mask |= uint32(1) << p
+		}
+	}
+	return mask
+}
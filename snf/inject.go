@@ -30,8 +30,13 @@ int go_inject_sched_v(snf_inject_t inj, int timeout_ms, int flags,
 import "C"
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
@@ -57,6 +62,72 @@ func (s *InjectStats) NicBytesSend() uint64 {
 	return uint64(s.nic_bytes_send)
 }
 
+// Packet size limits for injection.
+const (
+	// MinPacketSize is the minimum valid packet size. Packets
+	// smaller than that are accepted and padded by the hardware.
+	MinPacketSize = 60
+	// MaxPacketSize is the maximum valid packet size enforced by
+	// the library.
+	MaxPacketSize = 9000
+)
+
+// MaxFragments is the maximum number of fragments a packet may be
+// assembled from with SendVec() and SchedVec(), including the
+// fragment of zeros appended by padding (see PadTo()).
+//
+// This limit is imposed by the library, not by SNF which doesn't
+// document the maximum number of fragments it accepts. The value
+// equals the size of the fragment buffer preallocated by NewSender().
+// Please note that previously more fragments were accepted by growing
+// the buffer, now ErrFragments is returned instead.
+const MaxFragments = 100
+
+// ErrPacketSize is returned if the packet to inject has invalid
+// length.
+type ErrPacketSize struct {
+	// Len is the offending packet length.
+	Len int
+}
+
+// Error implements error interface.
+func (e *ErrPacketSize) Error() string {
+	return fmt.Sprintf("invalid packet size: %d bytes (max %d)", e.Len, MaxPacketSize)
+}
+
+func checkPktSize(length int) error {
+	if length <= 0 || length > MaxPacketSize {
+		return &ErrPacketSize{length}
+	}
+	return nil
+}
+
+// ErrFragments is returned if the packet to inject is assembled from
+// too many fragments.
+type ErrFragments struct {
+	// Count is the offending number of fragments.
+	Count int
+}
+
+// Error implements error interface.
+func (e *ErrFragments) Error() string {
+	return fmt.Sprintf("too many packet fragments: %d (max %d)", e.Count, MaxFragments)
+}
+
+func checkFragCount(n int) error {
+	if n > MaxFragments {
+		return &ErrFragments{n}
+	}
+	return nil
+}
+
+func fragsLen(pkt [][]byte) (n int) {
+	for _, data := range pkt {
+		n += len(data)
+	}
+	return n
+}
+
 // type InjectHandle struct {
 // inj   C.snf_inject_t
 // wg    sync.WaitGroup
@@ -72,7 +143,51 @@ func (s *InjectStats) NicBytesSend() uint64 {
 // InjectHandle is an opaque injection handle, allocated by
 // OpenInjectHandle. There are only a limited amount of injection
 // handles per NIC/port.
-type InjectHandle C.struct_snf_inject_handle
+type InjectHandle struct {
+	inj     C.snf_inject_t
+	portnum int
+
+	// serializes Close(); closed is 1 once the handle is closed
+	closeMtx sync.Mutex
+	closed   uint32
+}
+
+// number of injection handles opened by this process per port
+var injOpened = struct {
+	sync.Mutex
+	m map[int]int
+}{m: make(map[int]int)}
+
+func injOpenedAdd(portnum, delta int) {
+	injOpened.Lock()
+	defer injOpened.Unlock()
+	injOpened.m[portnum] += delta
+}
+
+// InjectHandlesAvail returns number of injection handles which may
+// still be opened on the port with OpenInjectHandle(). The number is
+// calculated as the port's MaxInject() less the number of injection
+// handles opened and not yet closed by this process.
+//
+// Please note that injection handles opened by other processes are
+// not accounted for so OpenInjectHandle() may still return EBUSY.
+//
+// ENODEV is returned if the port is not found.
+func InjectHandlesAvail(portnum int) (int, error) {
+	ifa, err := lookupIfAddr(func(ifa *IfAddrs) bool {
+		return ifa.PortNum() == uint32(portnum)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	injOpened.Lock()
+	defer injOpened.Unlock()
+	if n := ifa.MaxInject() - injOpened.m[portnum]; n > 0 {
+		return n, nil
+	}
+	return 0, nil
+}
 
 // OpenInjectHandle opens a port for injection and allocate an
 // injection handle.
@@ -96,11 +211,16 @@ func OpenInjectHandle(portnum int, flags ...int) (h *InjectHandle, err error) {
 		x |= C.int(f)
 	}
 	var inj C.snf_inject_t
-	return (*InjectHandle)(unsafe.Pointer(inj)), retErr(C.snf_inject_open(C.int(portnum), x, &inj))
+	if err := retErr(C.snf_inject_open(C.int(portnum), x, &inj)); err != nil {
+		return nil, err
+	}
+
+	injOpenedAdd(portnum, 1)
+	return &InjectHandle{inj: inj, portnum: portnum}, nil
 }
 
 func injHandle(inj *InjectHandle) C.snf_inject_t {
-	return C.snf_inject_t(unsafe.Pointer(inj))
+	return inj.inj
 }
 
 // Close closes injection handle and ensures that all pending sends
@@ -110,8 +230,45 @@ func injHandle(inj *InjectHandle) C.snf_inject_t {
 // pending sends have been sent out on the wire. The handle is then
 // made available again for the underlying port’s limited amount of
 // handles.
+//
+// Subsequent calls to Close return nil.
 func (h *InjectHandle) Close() error {
-	return retErr(C.snf_inject_close(injHandle(h)))
+	h.closeMtx.Lock()
+	defer h.closeMtx.Unlock()
+	if atomic.LoadUint32(&h.closed) > 0 {
+		return nil
+	}
+	err := retErr(C.snf_inject_close(injHandle(h)))
+	if err == nil {
+		injOpenedAdd(h.portnum, -1)
+		atomic.StoreUint32(&h.closed, 1)
+	}
+	return err
+}
+
+// CloseWithTimeout is the same as Close but it doesn't wait for the
+// pending sends to be flushed for longer than d. The handle is closed
+// in a separate goroutine and ETIMEDOUT is returned if it doesn't
+// complete in time.
+//
+// On timeout the state of the handle is indeterminate: it may still
+// be closed eventually or remain stuck. The handle should not be used
+// any further, but the caller may proceed with process exit.
+func (h *InjectHandle) CloseWithTimeout(d time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Close()
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return syscall.ETIMEDOUT
+	}
 }
 
 // GetStats gets statistics from an injection handle.
@@ -137,6 +294,9 @@ func (h *InjectHandle) GetSpeed() (speed uint64, err error) {
 
 // Sender object wraps SNF injection API and provides packet sending
 // capabilities with some safeguarding.
+//
+// Sender reuses internal buffers across calls so it may not be used
+// from multiple goroutines concurrently. Use SyncSender for that.
 type Sender struct {
 	*InjectHandle
 	sigCh <-chan os.Signal
@@ -153,6 +313,15 @@ type Sender struct {
 
 	// protect the memory from GC. Sender must be allocated in heap.
 	guardPkts [][]byte
+
+	// minimum length of packet to pad to and padding buffers
+	padTo    int
+	zeros    []byte
+	padBuf   []byte
+	padFrags [][]byte
+
+	// frame buffer for SendStream
+	streamBuf []byte
 }
 
 // NewSender returns new Sender object with given timeout and flags
@@ -165,26 +334,51 @@ type Sender struct {
 // error.
 //
 // Flags are currently not supported and should be set to 0.
+//
+// The fragment buffer used by SendVec and SchedVec is preallocated for
+// MaxFragments fragments, see NewSenderWithFrags.
 func NewSender(h *InjectHandle, timeout time.Duration, flags int) *Sender {
+	return NewSenderWithFrags(h, timeout, flags, MaxFragments)
+}
+
+// NewSenderWithFrags is the same as NewSender but the fragment buffer
+// used by SendVec and SchedVec is preallocated for maxFrags fragments.
+// If a packet is assembled from more fragments, the buffer is
+// reallocated. Use 0 if SendVec and SchedVec are never used.
+//
+// maxFrags is limited to MaxFragments since SendVec and SchedVec
+// reject packets assembled from more fragments.
+func NewSenderWithFrags(h *InjectHandle, timeout time.Duration, flags int, maxFrags int) *Sender {
+	if maxFrags > MaxFragments {
+		maxFrags = MaxFragments
+	} else if maxFrags < 0 {
+		maxFrags = 0
+	}
+
 	return &Sender{
 		InjectHandle: h,
 		timeoutMs:    C.int(dur2ms(timeout)),
 		flags:        C.int(flags),
-		frags:        make([]C.struct_snf_pkt_fragment, 100),
+		frags:        make([]C.struct_snf_pkt_fragment, maxFrags),
 	}
 }
 
 // make fragments vector out of slice of slices and calculate
 // overall length of packet's fragments to use as a hint for SNF
-// injection API.
-func makeFrags(pkt [][]byte, frags []C.struct_snf_pkt_fragment) (sz C.uint) {
-	for i, data := range pkt {
-		frags[i].ptr = unsafe.Pointer(&data[0])
-		frags[i].length = C.uint(len(data))
-		sz += frags[i].length
+// injection API. Empty fragments are skipped so the number of
+// fragments in the vector is returned as well.
+func makeFrags(pkt [][]byte, frags []C.struct_snf_pkt_fragment) (n C.int, sz C.uint) {
+	for _, data := range pkt {
+		if len(data) == 0 {
+			continue
+		}
+		frags[n].ptr = unsafe.Pointer(&data[0])
+		frags[n].length = C.uint(len(data))
+		sz += frags[n].length
+		n++
 	}
 
-	return sz
+	return n, sz
 }
 
 func (s *Sender) checkFragBuf(length int) {
@@ -193,6 +387,40 @@ func (s *Sender) checkFragBuf(length int) {
 	}
 }
 
+// PadTo makes Sender pad packets shorter than minLen bytes with zeros
+// up to minLen bytes in software before injecting them, instead of
+// relying on the hardware padding. This applies to Send, SendVec,
+// Sched and SchedVec methods. For SendVec and SchedVec, a fragment of
+// zeros is appended so the packet is not copied.
+//
+// minLen is limited to MaxPacketSize. If minLen is 0 or less,
+// padding is disabled which is the default.
+func (s *Sender) PadTo(minLen int) {
+	if minLen > MaxPacketSize {
+		minLen = MaxPacketSize
+	}
+	s.padTo = minLen
+	if len(s.zeros) < minLen {
+		s.zeros = make([]byte, minLen)
+	}
+}
+
+func (s *Sender) pad(pkt []byte) []byte {
+	if d := s.padTo - len(pkt); d > 0 {
+		s.padBuf = append(append(s.padBuf[:0], pkt...), s.zeros[:d]...)
+		return s.padBuf
+	}
+	return pkt
+}
+
+func (s *Sender) padVec(pkt [][]byte, length int) [][]byte {
+	if d := s.padTo - length; d > 0 {
+		s.padFrags = append(append(s.padFrags[:0], pkt...), s.zeros[:d])
+		return s.padFrags
+	}
+	return pkt
+}
+
 // NotifyWith installs signal notification channel which is presumably
 // registered via signal.Notify.
 func (s *Sender) NotifyWith(ch <-chan os.Signal) {
@@ -235,8 +463,9 @@ func (s *Sender) checkSignal() error {
 // have blocked at least that many milliseconds before resources could
 // become available.
 //
-// EINVAL error will be returned in case packet length is larger than
-// 9000 bytes.
+// *ErrPacketSize error will be returned in case packet is empty or its
+// length is larger than MaxPacketSize bytes. No call to SNF is made in
+// this case.
 //
 // If successful, the packet is completely buffered for sending by
 // SNF. The implementation guarantees that it will eventually send the
@@ -246,17 +475,93 @@ func (s *Sender) Send(pkt []byte) error {
 	if err := s.checkSignal(); err != nil {
 		return err
 	}
+	if err := checkPktSize(len(pkt)); err != nil {
+		return err
+	}
+	pkt = s.pad(pkt)
 	return retErr(C.snf_inject_send(injHandle(s.InjectHandle), s.timeoutMs,
 		s.flags, unsafe.Pointer(&pkt[0]), C.uint(len(pkt))))
 }
 
+// SendRetry sends a packet with Send and retries up to attempts times
+// if EAGAIN error is returned, sleeping for backoff between
+// attempts. Signal notification channel installed with NotifyWith is
+// checked before each attempt.
+//
+// If the packet could not be sent, the last encountered error is
+// returned.
+func (s *Sender) SendRetry(pkt []byte, attempts int, backoff time.Duration) (err error) {
+	for i := 0; i < attempts || i == 0; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+		}
+		if err = s.Send(pkt); err != syscall.EAGAIN {
+			break
+		}
+	}
+	return err
+}
+
+// SendStream reads frames from r and sends each of them with Send.
+// Every frame in r should be prefixed with its length as 2-byte
+// big-endian unsigned integer. A single buffer is reused for all
+// frames.
+//
+// Sending stops once r is exhausted, in which case nil error is
+// returned, or if reading or sending a frame fails. Number of frames
+// sent is returned. If r ends in the middle of a frame,
+// io.ErrUnexpectedEOF is returned.
+func (s *Sender) SendStream(r io.Reader) (n int, err error) {
+	if s.streamBuf == nil {
+		s.streamBuf = make([]byte, 2, 2+MaxPacketSize)
+	}
+
+	for {
+		hdr := s.streamBuf[:2]
+		if _, err = io.ReadFull(r, hdr); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		length := int(binary.BigEndian.Uint16(hdr))
+		if cap(s.streamBuf) < 2+length {
+			s.streamBuf = make([]byte, 2, 2+length)
+		}
+
+		pkt := s.streamBuf[2 : 2+length]
+		if _, err = io.ReadFull(r, pkt); err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return n, err
+		}
+
+		if err = s.Send(pkt); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
 // SendBulk sends packets in bulk using snf_inject_send. It returns number of
 // packets successfully sent, and if there are errors, it returns the first
 // error found, or nil.
+//
+// Every packet is validated as in Send() before any of them is sent,
+// so *ErrPacketSize error is returned with no packets sent if any of
+// them is empty or larger than MaxPacketSize bytes.
 func (s *Sender) SendBulk(pkts [][]byte) (int, error) {
 	if err := s.checkSignal(); err != nil {
 		return 0, err
 	}
+	if len(pkts) == 0 {
+		return 0, nil
+	}
+	for _, pkt := range pkts {
+		if err := checkPktSize(len(pkt)); err != nil {
+			return 0, err
+		}
+	}
 
 	s.guardPkts = pkts
 	s.pkts = s.pkts[:0]
@@ -292,8 +597,11 @@ func (s *Sender) SendBulk(pkts [][]byte) (int, error) {
 // have blocked at least that many milliseconds before resources could
 // become available.
 //
-// EINVAL error will be returned in case overall fragments length is
-// larger than 9000 bytes.
+// *ErrPacketSize error will be returned in case overall fragments
+// length is zero or larger than MaxPacketSize bytes. *ErrFragments
+// error will be returned in case there are more than MaxFragments
+// fragments. No call to SNF is made in these cases. Empty fragments
+// are skipped but still counted against MaxFragments.
 //
 // If successful, the packet is completely buffered for sending by
 // SNF. The implementation guarantees that it will eventually send the
@@ -303,11 +611,19 @@ func (s *Sender) SendVec(pkt ...[]byte) error {
 	if err := s.checkSignal(); err != nil {
 		return err
 	}
+	length := fragsLen(pkt)
+	if err := checkPktSize(length); err != nil {
+		return err
+	}
+	pkt = s.padVec(pkt, length)
+	if err := checkFragCount(len(pkt)); err != nil {
+		return err
+	}
 	s.checkFragBuf(len(pkt))
-	hint := makeFrags(pkt, s.frags)
+	n, hint := makeFrags(pkt, s.frags)
 	return retErr(C.go_inject_send_v(injHandle(s.InjectHandle), s.timeoutMs,
 		s.flags, C.uintptr_t(uintptr(unsafe.Pointer(&s.frags[0]))),
-		C.int(len(pkt)), hint))
+		n, hint))
 }
 
 // Sched sends a packet with hardware delay and optionally blocks
@@ -338,8 +654,9 @@ func (s *Sender) SendVec(pkt ...[]byte) error {
 // have blocked at least that many milliseconds before resources could
 // become available.
 //
-// EINVAL error will be returned in case packet length is larger than
-// 9000 bytes.
+// *ErrPacketSize error will be returned in case packet is empty or its
+// length is larger than MaxPacketSize bytes. No call to SNF is made in
+// this case.
 //
 // ENOTSUP error will be returned in case hardware doesnt support
 // injection pacing.
@@ -351,6 +668,10 @@ func (s *Sender) Sched(delayNs int64, pkt []byte) error {
 	if err := s.checkSignal(); err != nil {
 		return err
 	}
+	if err := checkPktSize(len(pkt)); err != nil {
+		return err
+	}
+	pkt = s.pad(pkt)
 	return retErr(C.snf_inject_sched(injHandle(s.InjectHandle), s.timeoutMs,
 		s.flags, unsafe.Pointer(&pkt[0]), C.uint(len(pkt)), C.ulong(delayNs)))
 }
@@ -382,8 +703,11 @@ func (s *Sender) Sched(delayNs int64, pkt []byte) error {
 // have blocked at least that many milliseconds before resources could
 // become available.
 //
-// EINVAL error will be returned in case packet length is larger than
-// 9000 bytes.
+// *ErrPacketSize error will be returned in case packet is empty or its
+// length is larger than MaxPacketSize bytes. *ErrFragments error will
+// be returned in case there are more than MaxFragments fragments. No
+// call to SNF is made in these cases. Empty fragments are skipped but
+// still counted against MaxFragments.
 //
 // ENOTSUP error will be returned in case hardware doesnt support
 // injection pacing.
@@ -395,9 +719,81 @@ func (s *Sender) SchedVec(delayNs int64, pkt ...[]byte) error {
 	if err := s.checkSignal(); err != nil {
 		return err
 	}
+	length := fragsLen(pkt)
+	if err := checkPktSize(length); err != nil {
+		return err
+	}
+	pkt = s.padVec(pkt, length)
+	if err := checkFragCount(len(pkt)); err != nil {
+		return err
+	}
 	s.checkFragBuf(len(pkt))
-	hint := makeFrags(pkt, s.frags)
+	n, hint := makeFrags(pkt, s.frags)
 	return retErr(C.go_inject_sched_v(injHandle(s.InjectHandle), s.timeoutMs,
-		s.flags, C.uintptr_t(uintptr(unsafe.Pointer(&s.frags[0]))), C.int(len(pkt)),
+		s.flags, C.uintptr_t(uintptr(unsafe.Pointer(&s.frags[0]))), n,
 		hint, C.ulong(delayNs)))
 }
+
+func delay2ns(delay time.Duration) int64 {
+	if delay < 0 {
+		return 0
+	}
+	return delay.Nanoseconds()
+}
+
+// SchedAfter is the same as Sched but accepts delay as
+// time.Duration. Negative delay is treated as 0.
+func (s *Sender) SchedAfter(delay time.Duration, pkt []byte) error {
+	return s.Sched(delay2ns(delay), pkt)
+}
+
+// SchedVecAfter is the same as SchedVec but accepts delay as
+// time.Duration. Negative delay is treated as 0.
+func (s *Sender) SchedVecAfter(delay time.Duration, pkt ...[]byte) error {
+	return s.SchedVec(delay2ns(delay), pkt...)
+}
+
+// ScheduledPacket is a packet to inject with SchedBatch.
+type ScheduledPacket struct {
+	// Delay is the minimum delay between the start of the prior
+	// packet and the start of this packet. Negative delay is treated
+	// as 0.
+	Delay time.Duration
+	// Data is the packet to inject.
+	Data []byte
+}
+
+// SchedBatch injects packets according to the schedule with Sched so
+// the hardware paces them. Number of packets accepted is returned
+// along with the first error encountered which stops the injection.
+//
+// If the hardware doesn't support injection pacing, i.e. Sched
+// returns ENOTSUP, the rest of the schedule is injected with Send and
+// paced in software by sleeping between packets, which is much less
+// precise.
+func (s *Sender) SchedBatch(schedule []ScheduledPacket) (int, error) {
+	for i, p := range schedule {
+		err := s.SchedAfter(p.Delay, p.Data)
+		if err == syscall.ENOTSUP {
+			n, err := s.schedSoftware(schedule[i:])
+			return i + n, err
+		} else if err != nil {
+			return i, err
+		}
+	}
+	return len(schedule), nil
+}
+
+func (s *Sender) schedSoftware(schedule []ScheduledPacket) (int, error) {
+	var last time.Time
+	for i, p := range schedule {
+		if !last.IsZero() {
+			time.Sleep(time.Until(last.Add(p.Delay)))
+		}
+		last = time.Now()
+		if err := s.Send(p.Data); err != nil {
+			return i, err
+		}
+	}
+	return len(schedule), nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which can be
+// found in the LICENSE file in the root of the source tree.
+
+package snf
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// InjectPool spreads packet injection across a number of Senders
+// in round-robin fashion. Since there are only a limited amount of
+// injection handles per port, the pool allows to utilize several of
+// them from multiple goroutines.
+//
+// InjectPool is safe for concurrent use. Each Sender is used by only
+// one goroutine at a time so Senders supplied to the pool should not
+// be used elsewhere.
+type InjectPool struct {
+	senders []*Sender
+	mtx     []sync.Mutex
+
+	// next sender to use
+	next uint32
+
+	// 1 if pool is closed
+	closed int32
+}
+
+// NewInjectPool creates new InjectPool out of given Senders. At least
+// one Sender should be specified, otherwise EINVAL is returned.
+func NewInjectPool(senders ...*Sender) (*InjectPool, error) {
+	if len(senders) == 0 {
+		return nil, syscall.EINVAL
+	}
+	return &InjectPool{
+		senders: senders,
+		mtx:     make([]sync.Mutex, len(senders)),
+	}, nil
+}
+
+// Send sends a packet with the next Sender in the pool. See Sender's
+// Send() method for details.
+//
+// io.EOF is returned if the pool is closed.
+func (p *InjectPool) Send(pkt []byte) error {
+	n := len(p.senders)
+	i := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+
+	p.mtx[i].Lock()
+	defer p.mtx[i].Unlock()
+	if atomic.LoadInt32(&p.closed) > 0 {
+		return io.EOF
+	}
+	return p.senders[i].Send(pkt)
+}
+
+// GetStats returns statistics summed over all injection handles in
+// the pool.
+//
+// Please note that hardware counters (NicPktSend, NicBytesSend) are
+// counted per port and apply to all injection handles of the port.
+// If several handles in the pool belong to the same port, these
+// counters will be summed multiple times.
+func (p *InjectPool) GetStats() (*InjectStats, error) {
+	total := &InjectStats{}
+	for _, s := range p.senders {
+		stats, err := s.GetStats()
+		if err != nil {
+			return nil, err
+		}
+		total.inj_pkt_send += stats.inj_pkt_send
+		total.nic_pkt_send += stats.nic_pkt_send
+		total.nic_bytes_send += stats.nic_bytes_send
+	}
+	return total, nil
+}
+
+// Close waits for all sends in progress to complete and closes all
+// injection handles in the pool, ensuring that all pending sends are
+// sent by the NIC. The first encountered error is returned.
+//
+// Subsequent calls to Send() will return io.EOF.
+func (p *InjectPool) Close() (err error) {
+	atomic.StoreInt32(&p.closed, 1)
+	for i, s := range p.senders {
+		p.mtx[i].Lock()
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+		p.mtx[i].Unlock()
+	}
+	return err
+}
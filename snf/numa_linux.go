@@ -0,0 +1,42 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which can be
+// found in the LICENSE file in the root of the source tree.
+
+//go:build linux
+// +build linux
+
+package snf
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// get_mempolicy(2) flags
+const (
+	mpolFNode = 1 << 0
+	mpolFAddr = 1 << 1
+)
+
+// NumaNode returns NUMA node the receive ring's data memory resides
+// on. The node is determined with get_mempolicy(2) system call by the
+// address of the data ring (see Data()).
+//
+// The reader of the ring may be pinned to a CPU local to the node to
+// avoid remote memory access.
+func (pi *RingPortInfo) NumaNode() (int, error) {
+	data := pi.Data()
+	if len(data) == 0 {
+		return -1, syscall.EINVAL
+	}
+
+	var node int32
+	_, _, errno := syscall.Syscall6(syscall.SYS_GET_MEMPOLICY,
+		uintptr(unsafe.Pointer(&node)), 0, 0,
+		uintptr(unsafe.Pointer(&data[0])), mpolFNode|mpolFAddr, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(node), nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which can be
+// found in the LICENSE file in the root of the source tree.
+
+//go:build !linux
+// +build !linux
+
+package snf
+
+import (
+	"syscall"
+)
+
+// NumaNode returns NUMA node the receive ring's data memory resides
+// on. It is only supported on Linux, ENOTSUP is returned otherwise.
+func (pi *RingPortInfo) NumaNode() (int, error) {
+	return -1, syscall.ENOTSUP
+}
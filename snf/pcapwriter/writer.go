@@ -0,0 +1,193 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package pcapwriter implements writing captured packets to pcapng
+// files with rotation by size or time.
+package pcapwriter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/yerden/go-snf/snf"
+)
+
+// file name timestamp layout
+const timeLayout = "20060102-150405.000000"
+
+// Writer writes packets to pcapng files named with the given prefix,
+// the time the file was created and the sequence number of the file,
+// e.g. "prefix-20190102-150405.000000-0000.pcapng". The sequence number
+// keeps the names distinct if files are rotated faster than the clock
+// advances. Once the file exceeds the specified size or age, Writer
+// rotates to a new file.
+//
+// Writer is safe for concurrent use so multiple goroutines receiving
+// packets from different rings may share it.
+type Writer struct {
+	prefix   string
+	maxBytes int64
+	maxAge   time.Duration
+	snapLen  uint32
+
+	mtx     sync.Mutex
+	f       *os.File
+	w       *pcapgo.NgWriter
+	written int64
+	created time.Time
+
+	// sequence number of the next file
+	seq uint64
+}
+
+// Option specifies an option for creating a Writer.
+type Option struct {
+	f func(*Writer)
+}
+
+// OptMaxBytes specifies the size of a file in bytes after which
+// Writer rotates to a new file. If n is 0 or less, the files are not
+// rotated by size which is the default.
+func OptMaxBytes(n int64) Option {
+	return Option{func(w *Writer) {
+		w.maxBytes = n
+	}}
+}
+
+// OptMaxAge specifies the time after which Writer rotates to a new
+// file. The age is only checked when a packet is written. If d is 0
+// or less, the files are not rotated by time which is the default.
+func OptMaxAge(d time.Duration) Option {
+	return Option{func(w *Writer) {
+		w.maxAge = d
+	}}
+}
+
+// OptSnapLen specifies the snap length recorded in the files. It
+// doesn't truncate the packets. By default, it is 0 which means
+// unlimited.
+func OptSnapLen(n uint32) Option {
+	return Option{func(w *Writer) {
+		w.snapLen = n
+	}}
+}
+
+// New creates a Writer with the given file name prefix and options
+// and opens the first file.
+func New(prefix string, options ...Option) (*Writer, error) {
+	w := &Writer{prefix: prefix}
+	for _, opt := range options {
+		opt.f(w)
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s-%04d.pcapng", w.prefix, now.Format(timeLayout), w.seq)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	intf := pcapgo.DefaultNgInterface
+	intf.LinkType = layers.LinkTypeEthernet
+	intf.SnapLength = w.snapLen
+	ngw, err := pcapgo.NewNgWriterInterface(f, intf, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+
+	w.f, w.w, w.written, w.created = f, ngw, 0, now
+	w.seq++
+	return nil
+}
+
+func (w *Writer) close() error {
+	err := w.w.Flush()
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	w.f, w.w = nil, nil
+	return err
+}
+
+func (w *Writer) needRotate() bool {
+	return (w.maxBytes > 0 && w.written >= w.maxBytes) ||
+		(w.maxAge > 0 && time.Since(w.created) >= w.maxAge)
+}
+
+// WritePacket writes a packet with the given CaptureInfo to the
+// current file, rotating it first if needed. Packets are written
+// under the single interface of the file so ci.InterfaceIndex is
+// ignored.
+//
+// os.ErrClosed is returned if the Writer is closed.
+func (w *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.w == nil {
+		return os.ErrClosed
+	}
+
+	if w.written > 0 && w.needRotate() {
+		if err := w.close(); err != nil {
+			return err
+		}
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	ci.InterfaceIndex = 0
+	if err := w.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+
+	// enhanced packet block is 32 bytes plus data padded to 4 bytes
+	w.written += int64(32 + (len(data)+3)&^3)
+	return nil
+}
+
+// WriteReq writes a packet described by req. See WritePacket.
+func (w *Writer) WriteReq(req *snf.RecvReq) error {
+	return w.WritePacket(req.CaptureInfo(), req.Data())
+}
+
+// Flush writes buffered packets to the current file.
+func (w *Writer) Flush() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.w == nil {
+		return os.ErrClosed
+	}
+	return w.w.Flush()
+}
+
+// Close flushes buffered packets and closes the current file.
+// Subsequent calls to Close return nil.
+func (w *Writer) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.w == nil {
+		return nil
+	}
+	return w.close()
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapwriter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/yerden/go-snf/snf/pcapwriter"
+)
+
+func TestWriterRotate(t *testing.T) {
+	dir := t.TempDir()
+	w, err := pcapwriter.New(filepath.Join(dir, "cap"),
+		pcapwriter.OptMaxBytes(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 64)
+	ci := gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: 3,
+	}
+
+	// each packet takes 96 bytes so every second packet rotates
+	for i := 0; i < 4; i++ {
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(ci, data); err != os.ErrClosed {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "cap-*.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for {
+			if _, _, err := r.ReadPacketData(); err != nil {
+				break
+			}
+			n++
+		}
+		f.Close()
+		if n != 2 {
+			t.Fatalf("%s: expected 2 packets, got %d", name, n)
+		}
+	}
+}
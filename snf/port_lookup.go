@@ -0,0 +1,101 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PortLookup maps port numbers to Sniffer-capable interfaces. It is
+// built once from GetIfAddrs() so lookups are O(1) and don't
+// allocate, which makes it suitable for labeling packets received on
+// aggregated rings (see RecvReq's PortNum()).
+type PortLookup struct {
+	ifa   []*IfAddrs
+	names []string
+}
+
+// NewPortLookup creates new PortLookup out of interfaces returned by
+// GetIfAddrs().
+func NewPortLookup() (*PortLookup, error) {
+	list, err := GetIfAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	pl := &PortLookup{}
+	for i := range list {
+		n := int(list[i].PortNum())
+		if d := n + 1 - len(pl.ifa); d > 0 {
+			pl.ifa = append(pl.ifa, make([]*IfAddrs, d)...)
+			pl.names = append(pl.names, make([]string, d)...)
+		}
+		pl.ifa[n] = &list[i]
+		pl.names[n] = list[i].Name()
+	}
+	return pl, nil
+}
+
+// IfAddr returns the interface of the port portnum or nil if there is
+// no such port.
+func (pl *PortLookup) IfAddr(portnum int) *IfAddrs {
+	if portnum < 0 || portnum >= len(pl.ifa) {
+		return nil
+	}
+	return pl.ifa[portnum]
+}
+
+// Name returns the interface name of the port portnum or empty string
+// if there is no such port.
+func (pl *PortLookup) Name(portnum int) string {
+	if portnum < 0 || portnum >= len(pl.names) {
+		return ""
+	}
+	return pl.names[portnum]
+}
+
+// PortLookup built on first successful use by RingReader's
+// PortName()
+var defaultLookup struct {
+	mtx sync.Mutex
+	pl  atomic.Value
+}
+
+func getDefaultLookup() *PortLookup {
+	if pl, ok := defaultLookup.pl.Load().(*PortLookup); ok {
+		return pl
+	}
+
+	defaultLookup.mtx.Lock()
+	defer defaultLookup.mtx.Unlock()
+	if pl, ok := defaultLookup.pl.Load().(*PortLookup); ok {
+		return pl
+	}
+
+	pl, err := NewPortLookup()
+	if err != nil {
+		return nil
+	}
+	defaultLookup.pl.Store(pl)
+	return pl
+}
+
+// PortName returns the interface name of the port the packet
+// described by req arrived on, or empty string if the port is
+// unknown. PortLookup is built from GetIfAddrs() on the first call
+// and shared by all RingReaders.
+//
+// If GetIfAddrs() fails, e.g. if Init() was not called, empty string
+// is returned and the PortLookup is built again on the next call.
+// Use NewPortLookup() to examine the error.
+func (rr *RingReader) PortName(req *RecvReq) string {
+	if pl := getDefaultLookup(); pl != nil {
+		return pl.Name(req.PortNum())
+	}
+	return ""
+}
@@ -9,6 +9,9 @@ package snf
 import "C"
 
 import (
+	"io"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 )
 
@@ -22,16 +25,39 @@ import (
 // back in the kernel. The implementation makes no explicit step to make the
 // kernel-based processing any faster than it is when Sniffer is not being used
 // (in fact, it is probably much slower).
-type ReflectHandle C.char
+type ReflectHandle struct {
+	ref C.snf_netdev_reflect_t
+	h   *Handle
+
+	// 1 if reflect handle is closed
+	closed uint32
+}
 
 // ReflectEnable enables a network device for packet reflection and returns
 // ReflectHandle.
 //
 // As stated in SNF documentation, this call is always a success.
 func (h *Handle) ReflectEnable() (*ReflectHandle, error) {
-	var ref *ReflectHandle
-	return ref, retErr(C.snf_netdev_reflect_enable(handle(h),
-		(*C.snf_netdev_reflect_t)(unsafe.Pointer(&ref))))
+	ref := &ReflectHandle{h: h}
+	if err := retErr(C.snf_netdev_reflect_enable(handle(h), &ref.ref)); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (ref *ReflectHandle) isClosed() bool {
+	return atomic.LoadUint32(&ref.closed) > 0 || ref.h.isClosed()
+}
+
+// Close releases the reflect handle. Subsequent calls to Reflect will
+// return io.EOF error. SNF has no means to disable reflection
+// explicitly, so the reflect handle is merely made unusable. Closing
+// the Handle the reflect handle was enabled on has the same effect.
+//
+// Subsequent calls to Close return nil.
+func (ref *ReflectHandle) Close() error {
+	atomic.StoreUint32(&ref.closed, 1)
+	return nil
 }
 
 // Reflect a packet to the network device.
@@ -41,9 +67,16 @@ func (h *Handle) ReflectEnable() (*ReflectHandle, error) {
 // a valid Ethernet header.
 //
 // As stated in SNF documentation, this call is always a success. This
-// package's Reflect will return io.EOF error in case the underlying Handle is
-// about to close due to signal or user Close call.
+// package's Reflect will return io.EOF error in case the reflect handle or
+// the underlying Handle is closed, and EINVAL if the reflect handle is nil or
+// pkt is empty.
 func (ref *ReflectHandle) Reflect(pkt []byte) error {
-	return retErr(C.snf_netdev_reflect(C.snf_netdev_reflect_t(ref),
+	if ref == nil || len(pkt) == 0 {
+		return syscall.EINVAL
+	}
+	if ref.isClosed() {
+		return io.EOF
+	}
+	return retErr(C.snf_netdev_reflect(ref.ref,
 		unsafe.Pointer(&pkt[0]), C.uint(len(pkt))))
 }
@@ -6,20 +6,54 @@ package snf
 import "C"
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
 
 // Ring encapsulates a device's ring handle.
-type Ring C.struct_snf_ring
+type Ring struct {
+	ringh C.snf_ring_t
+
+	// handle the ring was opened on
+	h *Handle
+
+	// serializes Close(); closed is 1 once the ring is closed
+	closeMtx sync.Mutex
+	closed   uint32
+
+	// packets borrowed with RecvMany() and not yet returned, in
+	// order of reception; only tracked if enabled with
+	// TrackBorrowed()
+	track    bool
+	borrowed []borrowedReq
+}
+
+// borrowedReq tracks a packet borrowed from the data ring.
+type borrowedReq struct {
+	addr uintptr
+	size uint32
+}
+
+// ErrReturnOrder is returned by Ring's ReturnExactly() method if the
+// packets to return are not the oldest borrowed ones.
+var ErrReturnOrder = errors.New("packets to return are not the oldest borrowed ones")
 
 // RingPortInfo is a receive ring information.
 type RingPortInfo C.struct_snf_ring_portinfo
 
 // Ring returns a physical ring which may be a part of aggregated
 // ring.
+//
+// The returned Ring is not tracked by any Handle and should not be
+// closed.
 func (pi *RingPortInfo) Ring() *Ring {
-	return (*Ring)(unsafe.Pointer(pi.ring))
+	return &Ring{ringh: pi.ring}
 }
 
 // QueueSize returns size of the data queue.
@@ -40,7 +74,31 @@ func (pi *RingPortInfo) PortMask() uint32 {
 
 // Data returns underlying array of data for receive ring.
 func (pi *RingPortInfo) Data() []byte {
-	return array2Slice(uintptr(pi.data_addr), int(pi.data_size))
+	// data_addr is uintptr_t so reinterpret it as a pointer
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(&pi.data_addr))
+	return array2Slice(ptr, int(pi.data_size))
+}
+
+// RingPortSummary is a receive ring information summarized over all
+// physical rings of a possibly aggregated ring.
+type RingPortSummary struct {
+	// Total size of the data queues.
+	QueueSize uintptr
+	// Total number of physical ports delivering to the ring.
+	PortCnt uint32
+	// Combined mask of ports delivering to the ring.
+	PortMask uint32
+}
+
+// SummarizePortInfo sums QueueSize and PortCnt and combines PortMask
+// of the specified receive ring information.
+func SummarizePortInfo(pi []RingPortInfo) (sum RingPortSummary) {
+	for i := range pi {
+		sum.QueueSize += pi[i].QueueSize()
+		sum.PortCnt += pi[i].PortCnt()
+		sum.PortMask |= pi[i].PortMask()
+	}
+	return
 }
 
 // RingQInfo is a queue consumption information.
@@ -90,7 +148,11 @@ type RingStats struct {
 }
 
 func ring(r *Ring) C.snf_ring_t {
-	return C.snf_ring_t(unsafe.Pointer(r))
+	return r.ringh
+}
+
+func (r *Ring) isClosed() bool {
+	return atomic.LoadUint32(&r.closed) > 0
 }
 
 // Close a ring
@@ -109,8 +171,29 @@ func ring(r *Ring) C.snf_ring_t {
 // all other rings are also closed.  All packet data memory returned
 // by Ring or RingReceiver is reclaimed by SNF API and cannot be
 // dereferenced.
+//
+// Close must not be called concurrently with receiving packets from
+// the ring, e.g. with Recv() or RingReader's Next(), since SNF
+// releases the ring under a pending receive. Stop the receiving
+// goroutine first, e.g. with RingReader's NotifyWith(), and wait for
+// it to return. RingReader used on the closed ring afterwards reports
+// io.EOF error.
+//
+// Subsequent calls to Close return nil.
 func (r *Ring) Close() error {
-	return retErr(C.snf_ring_close(ring(r)))
+	r.closeMtx.Lock()
+	defer r.closeMtx.Unlock()
+	if r.isClosed() {
+		return nil
+	}
+	err := retErr(C.snf_ring_close(ring(r)))
+	if err == nil {
+		atomic.StoreUint32(&r.closed, 1)
+		if r.h != nil {
+			r.h.removeRing(r)
+		}
+	}
+	return err
 }
 
 // Stats returns statistics from a receive ring.
@@ -128,6 +211,63 @@ func (r *Ring) Stats() (*RingStats, error) {
 		(*C.struct_snf_ring_stats)(unsafe.Pointer(stats))))
 }
 
+// QInfo returns queue consumption information for the ring without
+// receiving any packets. It is cheap enough to be used for probing
+// how full the ring is from a monitoring goroutine separate from the
+// one receiving packets.
+func (r *Ring) QInfo() (qinfo RingQInfo, err error) {
+	err = retErr(C.snf_ring_recv_qinfo(ring(r),
+		(*C.struct_snf_ring_qinfo)(&qinfo)))
+	return
+}
+
+// WaitReady blocks until the ring has data available for receiving
+// or timeout expires. SNF doesn't expose a file descriptor for a ring
+// so readiness can't be integrated into epoll directly. Instead,
+// WaitReady polls queue consumption information (see QInfo()) without
+// receiving any packets, sleeping for a short while between polls.
+//
+// If the value of timeout is less than 0, WaitReady can block
+// indefinitely. If timeout expires, EAGAIN is returned. io.EOF is
+// returned if the ring is closed.
+//
+// Since the amount of available data is approximate, a subsequent
+// receive may still return EAGAIN.
+func (r *Ring) WaitReady(timeout time.Duration) error {
+	const maxPoll = time.Millisecond
+	poll := time.Microsecond
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if r.isClosed() {
+			return io.EOF
+		}
+
+		qinfo, err := r.QInfo()
+		if err != nil {
+			return err
+		}
+
+		if qinfo.Avail() > 0 {
+			return nil
+		}
+
+		if timeout >= 0 {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return syscall.EAGAIN
+			} else if poll > left {
+				poll = left
+			}
+		}
+
+		time.Sleep(poll)
+		if poll *= 2; poll > maxPoll {
+			poll = maxPoll
+		}
+	}
+}
+
 // PortInfo returns information for the ring.
 // For aggregated rings, returns information for each of the physical
 // rings.
@@ -137,11 +277,34 @@ func (r *Ring) PortInfo() ([]RingPortInfo, error) {
 		return nil, err
 	}
 
+	if count == 0 {
+		return nil, nil
+	}
+
 	pi := make([]RingPortInfo, count)
 	return pi, retErr(C.snf_ring_portinfo(ring(r),
 		(*C.struct_snf_ring_portinfo)(unsafe.Pointer(&pi[0]))))
 }
 
+// isAggregated returns true if the ring is known to receive packets
+// from more than one physical port.
+func (r *Ring) isAggregated() bool {
+	pi, err := r.PortInfo()
+	if err != nil {
+		return false
+	}
+	return len(pi) > 1 || (len(pi) == 1 && pi[0].PortCnt() > 1)
+}
+
+// PortSummary returns receive ring information summarized over all
+// physical rings, see PortInfo() and SummarizePortInfo(). It may be
+// used to verify that the ring opened with AggregatePortMask flag
+// actually merges the expected ports.
+func (r *Ring) PortSummary() (RingPortSummary, error) {
+	pi, err := r.PortInfo()
+	return SummarizePortInfo(pi), err
+}
+
 // Recv receives next packet from a receive ring.
 //
 // This function is used to return the next available packet in a
@@ -181,6 +344,19 @@ func (r *Ring) Recv(timeout time.Duration, req *RecvReq) error {
 	return retErr(C.snf_ring_recv(ring(r), dur2ms(timeout), (*C.struct_snf_recv_req)(req)))
 }
 
+// RecvNonBlocking receives next packet from a receive ring without
+// blocking.
+//
+// Unlike Recv() with zero timeout, which is rounded up to 1ms, this
+// method passes zero timeout to SNF as is so the call never enters a
+// blocking state and returns EAGAIN unless there is a packet waiting.
+// This is intended for busy-polling designs. Please be aware that
+// during heavy workload zero timeout may cause other applications
+// working on the same port to experience EINVAL error.
+func (r *Ring) RecvNonBlocking(req *RecvReq) error {
+	return retErr(C.snf_ring_recv(ring(r), 0, (*C.struct_snf_recv_req)(req)))
+}
+
 // RecvMany receives new packets from the ring following
 // borrow-many-return-many receive model.
 //
@@ -198,12 +374,33 @@ func (r *Ring) RecvMany(timeout time.Duration, reqs []RecvReq, qinfo *RingQInfo)
 	qi := (*C.struct_snf_ring_qinfo)(qinfo)
 	out := C.ring_recv_many(ring(r), dur2ms(timeout),
 		(*C.struct_snf_recv_req)(&reqs[0]), C.int(len(reqs)), qi)
-	return intErr(&out)
+	n, err := intErr(&out)
+	if err == nil && r.track {
+		for i := 0; i < n; i++ {
+			r.borrowed = append(r.borrowed, borrowedReq{
+				addr: uintptr(reqs[i].pkt_addr),
+				size: uint32(reqs[i].length_data),
+			})
+		}
+	}
+	return n, err
+}
+
+// ReqsBytes returns total captured length of packets in reqs and
+// total length of data ring slots they occupy, i.e. the amount of
+// data borrowed from the data ring.
+func ReqsBytes(reqs []RecvReq) (captured, buffered uint64) {
+	for i := range reqs {
+		captured += uint64(reqs[i].length)
+		buffered += uint64(reqs[i].length_data)
+	}
+	return
 }
 
 // ReturnMany returns memory of given packets back to the data ring.
 // Please be aware SNF API returns queued data with no regard to
-// supplied packets, i.e. in FIFO way.
+// supplied packets, i.e. in FIFO way. See ReturnExactly() for a
+// variant which enforces that.
 //
 // Error is returned in case snf_ring_return_many() was unsuccessful.
 func (r *Ring) ReturnMany(reqs []RecvReq, qinfo *RingQInfo) error {
@@ -217,5 +414,64 @@ func (r *Ring) ReturnMany(reqs []RecvReq, qinfo *RingQInfo) error {
 	}
 
 	qi := (*C.struct_snf_ring_qinfo)(qinfo)
-	return retErr(C.snf_ring_return_many(ring(r), datalen, qi))
+	if err := retErr(C.snf_ring_return_many(ring(r), datalen, qi)); err != nil {
+		return err
+	}
+
+	if !r.track {
+		return nil
+	}
+
+	// account returned data in FIFO way as SNF does
+	var n int
+	for sz := uint32(datalen); n < len(r.borrowed) && r.borrowed[n].size <= sz; n++ {
+		sz -= r.borrowed[n].size
+	}
+	r.borrowed = r.borrowed[:copy(r.borrowed, r.borrowed[n:])]
+	return nil
+}
+
+// TrackBorrowed enables or disables tracking of packets borrowed
+// with RecvMany() and returned with ReturnMany() which is required by
+// ReturnExactly(). Tracking is disabled by default so RecvMany() and
+// ReturnMany() don't pay for the bookkeeping. Changing the setting
+// discards the tracked packets so it should be done while no packets
+// are borrowed.
+//
+// Only RecvMany() and ReturnMany() are tracked. Packets received or
+// returned by other means, e.g. by RingReader, are not accounted so
+// they should not be mixed on the same ring with ReturnExactly().
+// The tracking is not safe for concurrent use, as is receiving
+// packets from the ring.
+func (r *Ring) TrackBorrowed(enable bool) {
+	r.track = enable
+	r.borrowed = nil
+}
+
+// ReturnExactly is similar to ReturnMany but ensures that reqs are
+// exactly the oldest packets borrowed with RecvMany() and not yet
+// returned, in order of reception. Since SNF returns data in FIFO
+// way, returning any other packets would make the accounting of
+// borrowed data drift.
+//
+// ErrReturnOrder is returned and nothing is returned to the ring if
+// reqs are not a prefix of the borrowed packets. An error wrapping
+// EINVAL is returned if tracking is not enabled with
+// TrackBorrowed().
+func (r *Ring) ReturnExactly(reqs []RecvReq, qinfo *RingQInfo) error {
+	if !r.track {
+		return fmt.Errorf("borrowed packets are not tracked: %w", syscall.EINVAL)
+	}
+
+	if len(reqs) > len(r.borrowed) {
+		return ErrReturnOrder
+	}
+
+	for i := range reqs {
+		if uintptr(reqs[i].pkt_addr) != r.borrowed[i].addr {
+			return ErrReturnOrder
+		}
+	}
+
+	return r.ReturnMany(reqs, qinfo)
 }
@@ -14,30 +14,69 @@ import "C"
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"runtime"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
 )
 
 // RingReader wraps SNF's borrow-many-return-many model of packets
 // retrieval, along with google's gopacket interface. This allows us
 // to access low-level SNF API but maintain compatibility with
 // gopacket's layers decoding abilities.
+//
+// The underlying Ring must not be closed while RingReader is
+// receiving packets. See Ring's Close() method.
 type RingReader struct {
-	reader *C.struct_ring_reader
+	ring      *Ring
+	timeoutMs C.int
+
+	// packet descriptors vector
+	reqs []RecvReq
+
+	// ring is aggregated so only 1 packet may be received at once
+	aggregated bool
+
+	// number of descriptors currently borrowed from the ring
+	nreqOut int
+
+	// queue consumption information from the last burst
+	qinfo *RingQInfo
+
+	// timesource state of the handle at construction
+	timeSource    int
+	timeSourceErr error
+
+	// LoopNext retries on EINTR
+	retryEINTR bool
+
+	// maximum length of packet data, 0 if unlimited
+	snapLen int
+
+	// packets to reflect
+	reflect      *ReflectHandle
+	reflectMatch func([]byte) bool
 
 	// killed
-	stopped uint32
+	stopped  uint32
+	stopOnce sync.Once
 
-	sig os.Signal
+	// error to report once stopped
+	stopErr error
 
 	err error
 
 	// index of current snf_recv_req
-	n C.int
+	n int
+
+	// packets dropped by Channel()
+	dropped uint64
+
+	// maximum fraction of the data ring allowed to be borrowed, 0
+	// if unchecked
+	borrowLimit float64
 }
 
 // ErrSignal wraps os.Signal as an error.
@@ -48,16 +87,93 @@ func (e *ErrSignal) Error() string {
 	return fmt.Sprintf("Caught signal: %v", e.Signal)
 }
 
-func (rr *RingReader) recvReq(n C.int) *RecvReq {
-	p := unsafe.Pointer(rr.reader)
-	p = unsafe.Pointer(uintptr(p) + uintptr(C.RING_READER_REQ_VECTOR_OFF))
-	p = unsafe.Pointer(uintptr(p) + uintptr(n)*C.sizeof_struct_snf_recv_req)
-	return (*RecvReq)(p)
+// ReaderOption specifies an option for creating a RingReader.
+type ReaderOption struct {
+	f func(*RingReader)
+}
+
+// ReaderOptNonBlocking makes RingReader receive packets in truly
+// non-blocking mode, overriding the timeout specified in NewReader.
+// Next() will return false with EAGAIN error unless there are packets
+// waiting. See Ring's RecvNonBlocking() method for caveats.
+func ReaderOptNonBlocking() ReaderOption {
+	return ReaderOption{func(rr *RingReader) {
+		rr.timeoutMs = 0
+	}}
+}
+
+// ReaderOptBorrowLimit is a debugging option which makes Next()
+// panic if the amount of data borrowed from the ring exceeds the
+// fraction limit of the whole data ring, calculated from QInfo() as
+// Borrowed/(Avail+Borrowed+Free). It helps catching a consumer which
+// forgets to return packets (e.g. with Free() or Ring's ReturnMany())
+// and slowly starves the NIC.
+//
+// The check is performed after each burst is received. It is only
+// effective if the RingReader receives packets in bursts, i.e. burst
+// is greater than 1.
+func ReaderOptBorrowLimit(limit float64) ReaderOption {
+	return ReaderOption{func(rr *RingReader) {
+		rr.borrowLimit = limit
+	}}
+}
+
+func (rr *RingReader) checkBorrowed() {
+	q := rr.qinfo
+	total := q.Avail() + q.Borrowed() + q.Free()
+	if total == 0 {
+		return
+	}
+
+	if ratio := float64(q.Borrowed()) / float64(total); ratio > rr.borrowLimit {
+		panic(fmt.Sprintf("snf: %d of %d bytes of data ring borrowed (%.2f > %.2f)",
+			q.Borrowed(), total, ratio, rr.borrowLimit))
+	}
+}
+
+// ReaderOptReflect makes RingReader reflect packets for which match
+// returns true back to the kernel with ref instead of returning them
+// from Next(). Packets are reflected directly from the data ring
+// without copying.
+//
+// If reflecting fails, e.g. with io.EOF in case the underlying Handle
+// is about to close, Next() returns false and the error may be
+// examined with Err().
+func ReaderOptReflect(ref *ReflectHandle, match func(data []byte) bool) ReaderOption {
+	return ReaderOption{func(rr *RingReader) {
+		rr.reflect = ref
+		rr.reflectMatch = match
+	}}
+}
+
+// ReaderOptSnapLen limits packet data returned by RingReader's Data()
+// and gopacket interfaces to n bytes, mirroring libpcap's snaplen
+// semantics: CaptureInfo's CaptureLength is truncated to n while
+// Length holds the original packet length. Packet data is resliced,
+// not copied. If n is 0 or less, packet data is not truncated.
+//
+// Please note that RecvReq() still returns untruncated packet
+// descriptor.
+func ReaderOptSnapLen(n int) ReaderOption {
+	return ReaderOption{func(rr *RingReader) {
+		rr.snapLen = n
+	}}
+}
+
+func (rr *RingReader) snap(data []byte) []byte {
+	if rr.snapLen > 0 && len(data) > rr.snapLen {
+		return data[:rr.snapLen]
+	}
+	return data
+}
+
+func (rr *RingReader) reqVec() *C.struct_snf_recv_req {
+	return (*C.struct_snf_recv_req)(&rr.reqs[0])
 }
 
 // Ring returns underlying receive ring.
 func (rr *RingReader) Ring() *Ring {
-	return (*Ring)((*C.struct_snf_ring)(rr.reader.ringh))
+	return rr.ring
 }
 
 // Stats returns statistics from a receive ring.
@@ -68,49 +184,94 @@ func (rr *RingReader) Stats() (*RingStats, error) {
 // NewReader creates new RingReader.  timeout semantics is the same as
 // addressed in Recv() method.  burst is the amount of packets
 // received by underlying SNF's snf_ring_recv_many() function.
+// If burst is less than 1, it is set to 1.  options are applied to
+// RingReader in the order of appearance.
 //
-// Warning: please be aware that snf_ring_recv_many() doesn't work
-// with aggregated rings (flag AggregatePortMask must be off).  If you
-// want to use AggregatePortMask feature, please use burst==1. In that
-// case, RingReader will utilize snf_ring_recv() which works in both
-// cases.
-func NewReader(r *Ring, timeout time.Duration, burst int) *RingReader {
-	reader := (*C.struct_ring_reader)(C.malloc(C.ring_reader_size(C.int(burst))))
-	reader.ringh = (*C.struct_snf_ring)(r)
-	reader.timeout_ms = dur2ms(timeout)
-	reader.nreq_out = 0
-	reader.nreq_in = C.int(burst)
-
-	rr := &RingReader{reader: reader}
-	runtime.SetFinalizer(rr, func(rr *RingReader) {
-		C.free(unsafe.Pointer(rr.reader))
-	})
+// Please be aware that snf_ring_recv_many() doesn't work with
+// aggregated rings (flag AggregatePortMask must be off).  If the ring
+// is detected to be aggregated, i.e. Ring's PortInfo() reports more
+// than one physical port, burst is set to 1 regardless of the
+// specified value. In that case, RingReader will utilize
+// snf_ring_recv() which works in both cases.
+func NewReader(r *Ring, timeout time.Duration, burst int, options ...ReaderOption) *RingReader {
+	aggregated := r.isAggregated()
+	if burst < 1 || aggregated {
+		burst = 1
+	}
+
+	rr := &RingReader{
+		ring:       r,
+		aggregated: aggregated,
+		timeoutMs:  dur2ms(timeout),
+		reqs:       make([]RecvReq, burst),
+		qinfo:      &RingQInfo{},
+	}
+
+	if r.h != nil {
+		rr.timeSource, rr.timeSourceErr = r.h.TimeSourceState()
+	} else {
+		rr.timeSource, rr.timeSourceErr = TimeSourceLocal, syscall.EINVAL
+	}
+
+	for _, opt := range options {
+		opt.f(rr)
+	}
 	return rr
 }
 
 // Next gets next packet out of ring. If true, the operation is a
 // success, otherwise you should halt all actions on the receiver
 // until Err() error is examined and needed actions are performed.
+//
+// If RingReader was created with ReaderOptReflect option, matching
+// packets are reflected and skipped.
 func (rr *RingReader) Next() bool {
-	if rr.n++; rr.n >= rr.reader.nreq_out {
+	for rr.next() {
+		data := rr.req().Data()
+		if rr.reflect == nil || !rr.reflectMatch(data) {
+			return true
+		}
+
+		if rr.err = rr.reflect.Reflect(data); rr.err != nil {
+			return false
+		}
+	}
+
+	return false
+}
+
+func (rr *RingReader) next() bool {
+	if rr.n++; rr.n >= rr.nreqOut {
+		if rr.ring.isClosed() {
+			rr.nreqOut, rr.err = 0, io.EOF
+			return false
+		}
+
 		if atomic.LoadUint32(&rr.stopped) > 0 {
-			rr.err = &ErrSignal{rr.sig}
+			rr.err = rr.stopErr
 			return false
 		}
 
-		rr.err = retErr(C.ring_reader_recharge(rr.reader))
-		if rr.err != nil {
-			rr.reader.nreq_out = 0
+		out := C.ring_reader_recharge(ring(rr.ring), rr.timeoutMs,
+			rr.reqVec(), C.int(len(rr.reqs)), C.int(rr.nreqOut),
+			(*C.struct_snf_ring_qinfo)(rr.qinfo))
+		// on error, nreqOut is the number of packets that are
+		// still borrowed and should be returned with Free()
+		if rr.nreqOut, rr.err = intErr(&out); rr.err != nil {
 			return false
 		}
 		rr.n = 0
+
+		if rr.borrowLimit > 0 {
+			rr.checkBorrowed()
+		}
 	}
 
 	return true
 }
 
 func (rr *RingReader) req() *RecvReq {
-	return rr.recvReq(rr.n)
+	return &rr.reqs[rr.n]
 }
 
 // RecvReq returns current packet descriptor. This descriptor points
@@ -124,13 +285,105 @@ func (rr *RingReader) RecvReq() *RecvReq {
 // array of returned slice is owned by SNF API. Please make a copy if
 // you want to retain it. The consecutive Next() call may erase this
 // slice without prior notice.
+//
+// If RingReader was created with ReaderOptSnapLen option, the slice
+// is truncated accordingly.
 func (rr *RingReader) Data() []byte {
-	return rr.req().Data()
+	return rr.snap(rr.req().Data())
+}
+
+// ReadBurst retrieves up to len(dst) packets and copies their data
+// into dst, reusing the capacity of its slices. Number of packets
+// copied is returned.
+//
+// The first packet is retrieved with Next() so ReadBurst may block
+// according to the timeout of the RingReader. The rest of the packets
+// are only taken from the current burst so no further receiving is
+// performed. If no packet could be retrieved, 0 and Err() is
+// returned.
+//
+// Unlike Data(), the copied packets may be retained by the caller.
+func (rr *RingReader) ReadBurst(dst [][]byte) (n int, err error) {
+	for n < len(dst) {
+		if n > 0 && rr.n+1 >= rr.nreqOut {
+			break
+		}
+
+		if !rr.Next() {
+			if n == 0 {
+				err = rr.Err()
+			}
+			break
+		}
+
+		dst[n] = append(dst[n][:0], rr.Data()...)
+		n++
+	}
+
+	return n, err
+}
+
+// Truncated returns true if the current packet's data returned by
+// Data() is truncated according to ReaderOptSnapLen option.
+//
+// Please note that SNF doesn't report the original length of the
+// packet on the wire separately from the captured length, so packets
+// are never reported as truncated by SNF itself.
+func (rr *RingReader) Truncated() bool {
+	return rr.snapLen > 0 && rr.req().Length() > rr.snapLen
+}
+
+// BurstBytes returns total captured length of packets in the current
+// burst and total length of the data ring slots they occupy. See
+// ReqsBytes().
+func (rr *RingReader) BurstBytes() (captured, buffered uint64) {
+	return ReqsBytes(rr.reqs[:rr.nreqOut])
+}
+
+// TimeSource returns timesource state of the ring's Handle (see
+// Handle's TimeSourceState() method) captured when RingReader was
+// created. It tells whether the timestamps of received packets are
+// generated locally or synchronized with an external source.
+//
+// EINVAL is returned if the ring was not opened on a Handle.
+func (rr *RingReader) TimeSource() (int, error) {
+	return rr.timeSource, rr.timeSourceErr
+}
+
+// QInfo returns queue consumption information obtained during
+// receiving the last burst of packets. It is only updated if the
+// RingReader receives packets in bursts, i.e. burst is greater than
+// 1.
+//
+// The information is approximate as stated in RingQInfo but is good
+// enough to drive load shedding heuristics.
+func (rr *RingReader) QInfo() RingQInfo {
+	return *rr.qinfo
+}
+
+// Borrowed returns amount of data borrowed from the ring as of
+// receiving the last burst of packets. See QInfo().
+func (rr *RingReader) Borrowed() uintptr {
+	return rr.qinfo.Borrowed()
+}
+
+// FillRatio returns approximate fraction of the ring's data queue
+// occupied by packets not yet received, calculated from QInfo() as
+// Avail/(Avail+Free). It returns 0 if no information is available.
+func (rr *RingReader) FillRatio() float64 {
+	avail, free := rr.qinfo.Avail(), rr.qinfo.Free()
+	if avail+free == 0 {
+		return 0
+	}
+	return float64(avail) / float64(avail+free)
 }
 
 // Err returns error which was encountered during the last RingReader
 // operation on a ring. If Next() method returned false, the error
 // may be revised here.
+//
+// io.EOF is returned if the underlying ring was closed, meaning that
+// receiving operations should halt.
 func (rr *RingReader) Err() error {
 	return rr.err
 }
@@ -143,23 +396,167 @@ func (rr *RingReader) Err() error {
 // intend to use underlying ring further until it Close()-s.
 // Nevertheless, the use of this function is encouraged anyway as a
 // matter of good code style.
+//
+// Only packets currently borrowed by the RingReader are returned so
+// it is safe to call Free() after Next() failed or more than once.
 func (rr *RingReader) Free() error {
-	C.ring_reader_return_many(rr.reader)
+	if rr.ring.isClosed() {
+		// all packets are reclaimed by SNF on ring closing
+		rr.nreqOut = 0
+		return nil
+	}
+
+	err := retErr(C.ring_reader_return_many(ring(rr.ring), rr.reqVec(),
+		C.int(len(rr.reqs)), C.int(rr.nreqOut)))
+	if err == nil {
+		rr.nreqOut = 0
+	}
+	return err
+}
+
+// SetBurst changes the amount of packets received at once. All
+// packets of the current burst are returned to the ring first as in
+// Free(), so the packet retrieved with the last Next() call may not
+// be used afterwards. The next call to Next() will receive a new
+// burst of packets.
+//
+// If burst is less than 1 or the ring is aggregated, it is set to 1.
+func (rr *RingReader) SetBurst(burst int) error {
+	if burst < 1 || rr.aggregated {
+		burst = 1
+	}
+
+	if err := rr.Free(); err != nil {
+		return err
+	}
+
+	if burst != len(rr.reqs) {
+		rr.reqs = make([]RecvReq, burst)
+	}
 	return nil
 }
 
 // LoopNext is similar to Next() method but this one loops if EAGAIN
 // is encountered. It means that timeout hit and the port should be
 // polled again.
+//
+// If RetryOnEINTR(true) was called, LoopNext also loops if EINTR is
+// encountered, i.e. receiving was interrupted by an unrelated signal.
+// Signals installed with NotifyWith() still stop the RingReader.
 func (rr *RingReader) LoopNext() bool {
 	for !rr.Next() {
-		if rr.Err() != syscall.EAGAIN {
+		if err := rr.Err(); err != syscall.EAGAIN &&
+			(err != syscall.EINTR || !rr.retryEINTR) {
 			return false
 		}
 	}
 	return true
 }
 
+// LoopNextWithBackoff is similar to LoopNext() but it sleeps between
+// receive attempts which return EAGAIN so an idle ring doesn't keep a
+// CPU core busy. The first EAGAIN is retried immediately, then the
+// sleep interval starts with min and is doubled on every consecutive
+// EAGAIN up to max. The backoff starts over once a packet is
+// received.
+//
+// Signals installed with NotifyWith() are only detected between
+// sleeps so stopping may be delayed by up to max.
+func (rr *RingReader) LoopNextWithBackoff(min, max time.Duration) bool {
+	var d time.Duration
+	for !rr.Next() {
+		if err := rr.Err(); err != syscall.EAGAIN &&
+			(err != syscall.EINTR || !rr.retryEINTR) {
+			return false
+		} else if err != syscall.EAGAIN {
+			continue
+		}
+
+		if d > 0 {
+			time.Sleep(d)
+		}
+
+		if d == 0 {
+			d = min
+		} else if d *= 2; d > max {
+			d = max
+		}
+	}
+	return true
+}
+
+// RetryOnEINTR specifies whether LoopNext() should retry receiving
+// packets if EINTR is encountered. By default, it doesn't.
+func (rr *RingReader) RetryOnEINTR(retry bool) {
+	rr.retryEINTR = retry
+}
+
+// ForEach calls fn for every packet retrieved with LoopNext(). If fn
+// returns non-nil error, the loop stops and the error is returned.
+// Otherwise, the loop continues until LoopNext() returns false in
+// which case Err() is returned.
+//
+// The RecvReq passed to fn is subject to the same restrictions as
+// the one returned by RecvReq().
+func (rr *RingReader) ForEach(fn func(*RecvReq) error) error {
+	for rr.LoopNext() {
+		if err := fn(rr.req()); err != nil {
+			return err
+		}
+	}
+	return rr.Err()
+}
+
+// Channel starts a goroutine which retrieves packets with LoopNext()
+// and sends their copies over the returned channel with a buffer of
+// bufSize packets (at least 1). If the channel is full, the packet is dropped and
+// counted (see Dropped()) so receiving from the ring is never blocked
+// by a slow consumer.
+//
+// The returned function stops the RingReader at the next burst
+// boundary. Once the RingReader stops for any reason, its packets are
+// returned to the ring with Free() and the channel is closed. Err()
+// may be examined afterwards.
+//
+// The RingReader should not be used by other goroutines while the
+// channel is open.
+func (rr *RingReader) Channel(bufSize int) (<-chan CapturedPacket, func()) {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	ch := make(chan CapturedPacket, bufSize)
+	go func() {
+		defer close(ch)
+		defer rr.Free()
+		for rr.LoopNext() {
+			// this is the only sender so the packet is not copied
+			// in vain
+			if len(ch) == cap(ch) {
+				atomic.AddUint64(&rr.dropped, 1)
+			} else {
+				ch <- rr.capture()
+			}
+		}
+	}()
+
+	return ch, func() { rr.stop(io.EOF) }
+}
+
+// Dropped returns the number of packets dropped by Channel() because
+// the channel was full.
+func (rr *RingReader) Dropped() uint64 {
+	return atomic.LoadUint64(&rr.dropped)
+}
+
+// stop makes RingReader halt at the next burst boundary with the
+// given error. Only the first call has effect.
+func (rr *RingReader) stop(err error) {
+	rr.stopOnce.Do(func() {
+		rr.stopErr = err
+		atomic.StoreUint32(&rr.stopped, 1)
+	})
+}
+
 // NotifyWith installs signal notification channel which is presumably
 // registered via signal.Notify.
 //
@@ -168,8 +565,7 @@ func (rr *RingReader) LoopNext() bool {
 func (rr *RingReader) NotifyWith(ch <-chan os.Signal) {
 	go func() {
 		for sig := range ch {
-			rr.sig = sig
-			atomic.StoreUint32(&rr.stopped, 1)
+			rr.stop(&ErrSignal{sig})
 			break
 		}
 	}()
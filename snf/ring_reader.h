@@ -10,99 +10,95 @@
 #include <snf.h>
 #endif
 
-struct ring_reader {
-	snf_ring_t ringh;
-	int timeout_ms;
-	int nreq_out;
-	int nreq_in; // allocated elements of req_vector
-
-	struct snf_recv_req req_vector[0];
-};
-
-enum {
-	RING_READER_REQ_VECTOR_OFF = offsetof(struct ring_reader, req_vector[0]),
-};
-
-/*
- * Return required size to allocate for ring_reader to contain nreq_in
- * packet descriptors.
- */
-static size_t
-ring_reader_size(int nreq_in)
-{
-	struct ring_reader *reader;
-	return sizeof(*reader) + nreq_in * sizeof(reader->req_vector[0]);
-}
-
 /*
- * Return number of borrowed bytes by counting length_data from all
- * received packets in the reader.
+ * Return number of borrowed bytes by counting length_data from nreq
+ * received packets.
  */
 static uint32_t
-ring_reader_data_qlen(struct ring_reader *reader)
+ring_reader_data_qlen(struct snf_recv_req *req_vector, int nreq)
 {
 	int i;
 	uint32_t data_qlen = 0;
 
-	for (i = 0; i < reader->nreq_out; i++) {
-		data_qlen += reader->req_vector[i].length_data;
+	for (i = 0; i < nreq; i++) {
+		data_qlen += req_vector[i].length_data;
 	}
 
 	return data_qlen;
 }
 
 /*
- * Receive packets for the reader.
+ * Receive at most nreq_in packets into req_vector. If more than one
+ * descriptor is supplied, qinfo is filled with queue consumption
+ * information.
  *
- * 0 if received some packets.
- * non-0 if encountered some error.
+ * Number of received packets is returned in out.i[0], out.rc is 0 if
+ * received some packets and non-0 if encountered some error. In the
+ * latter case out.i[0] is always 0.
  */
-static int
-ring_reader_recv_many(struct ring_reader *reader)
+static struct compound_int
+ring_reader_recv_many(snf_ring_t ringh, int timeout_ms,
+		struct snf_recv_req *req_vector, int nreq_in,
+		struct snf_ring_qinfo *qinfo)
 {
-	if (reader->nreq_in == 1) {
-		int rc = snf_ring_recv(reader->ringh, reader->timeout_ms, &reader->req_vector[0]);
-		reader->nreq_out = !rc;
-		return rc;
+	struct compound_int out;
+	out.i[0] = 0;
+
+	if (nreq_in == 1) {
+		out.rc = snf_ring_recv(ringh, timeout_ms, &req_vector[0]);
+		out.i[0] = !out.rc;
+		return out;
 	}
 
-	reader->nreq_out = 0;
-	return snf_ring_recv_many(reader->ringh, reader->timeout_ms, reader->req_vector,
-			reader->nreq_in, &reader->nreq_out, NULL);
+	out.rc = snf_ring_recv_many(ringh, timeout_ms, req_vector,
+			nreq_in, &out.i[0], qinfo);
+	if (out.rc != 0) {
+		out.i[0] = 0;
+	}
+	return out;
 }
 
 /*
- * Return borrowed bytes from the reader.
+ * Return borrowed bytes of nreq_out packets received into
+ * req_vector.
  */
 static int
-ring_reader_return_many(struct ring_reader *reader)
+ring_reader_return_many(snf_ring_t ringh, struct snf_recv_req *req_vector,
+		int nreq_in, int nreq_out)
 {
-	int rc = 0;
-
-	if (reader->nreq_in > 1) {
+	if (nreq_in > 1 && nreq_out > 0) {
 		// it makes sense to return only if packets were received with
 		// snf_ring_recv_many i.e. more than one descriptor is
 		// supplied.
-		rc = snf_ring_return_many(reader->ringh, ring_reader_data_qlen(reader), NULL);
+		return snf_ring_return_many(ringh,
+				ring_reader_data_qlen(req_vector, nreq_out), NULL);
 	}
 
-	reader->nreq_out = 0;
-	return rc;
+	return 0;
 }
 
 /*
  * Return borrowed bytes and receive new packets.
+ *
+ * Number of packets borrowed after the call is returned in out.i[0].
+ * If returning failed, nreq_out packets are still borrowed.
  */
-static int
-ring_reader_recharge(struct ring_reader *reader)
+static struct compound_int
+ring_reader_recharge(snf_ring_t ringh, int timeout_ms,
+		struct snf_recv_req *req_vector, int nreq_in, int nreq_out,
+		struct snf_ring_qinfo *qinfo)
 {
-	int rc;
+	struct compound_int out;
+	out.i[0] = 0;
 
-	if (reader->nreq_out > 0 && ((rc = ring_reader_return_many(reader)) != 0)) {
-		return rc;
+	out.rc = ring_reader_return_many(ringh, req_vector, nreq_in, nreq_out);
+	if (out.rc != 0) {
+		out.i[0] = nreq_out;
+		return out;
 	}
 
-	return ring_reader_recv_many(reader);
+	return ring_reader_recv_many(ringh, timeout_ms, req_vector, nreq_in,
+			qinfo);
 }
 
 #endif /* _RING_READER_H_ */
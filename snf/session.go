@@ -0,0 +1,121 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Session runs a RingReader for each of the given rings of a Handle
+// in a separate goroutine and takes care of shutting them down in
+// the correct order: readers are stopped and their packets are
+// returned to the rings, then the rings are closed and finally the
+// Handle is closed.
+type Session struct {
+	h       *Handle
+	rings   []*Ring
+	readers []*RingReader
+	wg      sync.WaitGroup
+
+	// first error returned by a reader function
+	mtx sync.Mutex
+	err error
+}
+
+// NewSession starts packet capture on the Handle, creates a
+// RingReader for each ring with the specified timeout, burst and
+// options (see NewReader) and runs fn with each of them in a separate
+// goroutine.
+//
+// fn is expected to process packets until the RingReader stops, e.g.
+// with ForEach() method. Once the Session is closed, the RingReader
+// stops and its Err() returns io.EOF.
+//
+// If capture can't be started, no readers are run and the error is
+// returned. The rings and the Handle are left open in this case.
+func NewSession(h *Handle, rings []*Ring, fn func(*RingReader) error,
+	timeout time.Duration, burst int, options ...ReaderOption) (*Session, error) {
+	if err := h.Start(); err != nil {
+		return nil, err
+	}
+
+	s := &Session{h: h, rings: rings}
+	for _, r := range rings {
+		rr := NewReader(r, timeout, burst, options...)
+		s.readers = append(s.readers, rr)
+		s.wg.Add(1)
+		go func(rr *RingReader) {
+			defer s.wg.Done()
+			defer rr.Free()
+			if err := fn(rr); err != nil && err != io.EOF {
+				s.setErr(err)
+			}
+		}(rr)
+	}
+
+	return s, nil
+}
+
+func (s *Session) setErr(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Session) stop() {
+	for _, rr := range s.readers {
+		rr.stop(io.EOF)
+	}
+}
+
+// Err returns the first error returned by a reader function other
+// than io.EOF.
+func (s *Session) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
+
+// Close stops all readers and waits for them to return their packets
+// to the rings. Then it closes all the rings and the Handle.
+//
+// If ctx is done before all readers have stopped, ctx.Err() is
+// returned and nothing is closed. Otherwise, the first error
+// encountered while closing the rings or the Handle is returned.
+func (s *Session) Close(ctx context.Context) error {
+	s.stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+
+	var err error
+	for _, r := range s.rings {
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.h.Close()
+}
@@ -18,6 +18,12 @@ feature requests regarding extension of such integration are welcomed.
 
 Some examples are provided to show various use cases, features,
 limitations and so on.
+
+Please note the incompatible change of the API: open flags and RSS
+flags are typed as Flag and RSSFlag respectively, and HandlerOptFlags
+and HandlerOptRssFlags options accept these types instead of int.
+Constants and untyped literals are used as before, but int variables
+should be converted explicitly, e.g. HandlerOptFlags(snf.Flag(flags)).
 */
 package snf
 
@@ -27,7 +33,12 @@ package snf
 import "C"
 
 import (
-	"reflect"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
@@ -41,6 +52,29 @@ const (
 	Version uint16 = C.SNF_VERSION_API
 )
 
+// VersionMajor returns the major version of SNF API, i.e. the most
+// significant byte of Version.
+func VersionMajor() uint8 {
+	return uint8(Version >> 8)
+}
+
+// VersionMinor returns the minor version of SNF API, i.e. the least
+// significant byte of Version.
+func VersionMinor() uint8 {
+	return uint8(Version)
+}
+
+// VersionString returns SNF API version formatted as "major.minor".
+func VersionString() string {
+	return fmt.Sprintf("%d.%d", VersionMajor(), VersionMinor())
+}
+
+// CheckVersionAtLeast returns true if SNF API version is not less
+// than major.minor.
+func CheckVersionAtLeast(major, minor uint8) bool {
+	return Version >= uint16(major)<<8|uint16(minor)
+}
+
 // Underlying port's state (DOWN or UP)
 const (
 	// Link is down.
@@ -82,17 +116,55 @@ const (
 // hash.
 const (
 	// Include IP (v4 or v6) SRC/DST addr in hash
-	RssIP int = C.SNF_RSS_IP
+	RssIP RSSFlag = C.SNF_RSS_IP
 	// Include TCP/UDP/SCTP SRC port in hash
-	RssSrcPort = C.SNF_RSS_SRC_PORT
+	RssSrcPort RSSFlag = C.SNF_RSS_SRC_PORT
 	// Include TCP/UDP/SCTP DST port in hash
-	RssDstPort = C.SNF_RSS_DST_PORT
+	RssDstPort RSSFlag = C.SNF_RSS_DST_PORT
 	// Include GTP TEID in hash
-	RssGtp = C.SNF_RSS_GTP
+	RssGtp RSSFlag = C.SNF_RSS_GTP
 	// Include GRE contents in hash
-	RssGre = C.SNF_RSS_GRE
+	RssGre RSSFlag = C.SNF_RSS_GRE
 )
 
+// RSSFlag is a mask of RSS flags used with HandlerOptRssFlags option.
+type RSSFlag int
+
+var rssFlagNames = []flagName{
+	{int(RssIP), "RssIP"},
+	{int(RssSrcPort), "RssSrcPort"},
+	{int(RssDstPort), "RssDstPort"},
+	{int(RssGtp), "RssGtp"},
+	{int(RssGre), "RssGre"},
+}
+
+// String implements fmt.Stringer. Flags are rendered by name joined
+// with "|", e.g. "RssIP|RssSrcPort".
+func (f RSSFlag) String() string {
+	return flagsString(int(f), rssFlagNames)
+}
+
+// Flag is a mask of flags used when opening a Handle with
+// HandlerOptFlags option.
+type Flag int
+
+var flagNames = []flagName{
+	{int(PShared), "PShared"},
+	{int(AggregatePortMask), "AggregatePortMask"},
+	{int(RxDuplicate), "RxDuplicate"},
+}
+
+// String implements fmt.Stringer. Flags are rendered by name joined
+// with "|", e.g. "PShared|RxDuplicate". Negative value means default
+// flags as set in SNF_FLAGS environment variable and is rendered as
+// "Default".
+func (f Flag) String() string {
+	if f < 0 {
+		return "Default"
+	}
+	return flagsString(int(f), flagNames)
+}
+
 // Open flags for process-sharing, port aggregation and packet
 // duplication.  Used when opening a Handle with HandlerOptFlags
 // option.
@@ -105,7 +177,7 @@ const (
 	// a fraction of the traffic if multiple rings are used unless the
 	// RxDuplicate option is used, in which case each libpcap device
 	// sees the same incoming packets.
-	PShared = C.SNF_F_PSHARED
+	PShared Flag = C.SNF_F_PSHARED
 	// AggregatePortMask shows that device can be opened for port
 	// aggregation (or merging). When this flag is passed, the portnum
 	// parameter in OpenHandleWithOpts() is interpreted as a bitmask
@@ -115,7 +187,7 @@ const (
 	// from multiple ports. Subsequent calls to OpenRing() return a
 	// ring handle that internally opens a ring on all underlying
 	// ports.
-	AggregatePortMask = C.SNF_F_AGGREGATE_PORTMASK
+	AggregatePortMask Flag = C.SNF_F_AGGREGATE_PORTMASK
 	// RxDuplicate shows that device can duplicate packets to multiple
 	// rings as opposed to applying RSS in order to split incoming
 	// packets across rings. Users should be aware that with N rings
@@ -127,23 +199,41 @@ const (
 	//
 	// When duplication is enabled, RSS options are ignored since
 	// every packet is delivered to every ring.
-	RxDuplicate = C.SNF_F_RX_DUPLICATE
+	RxDuplicate Flag = C.SNF_F_RX_DUPLICATE
 )
 
 // RecvReq is a descriptor of a packet received on a data ring.
 type RecvReq C.struct_snf_recv_req
 
 // Data returns data payload of the packet as a pointer directly in
-// the given data ring.
+// the given data ring. Length and capacity of the returned slice are
+// both equal to the captured length of the packet.
 //
 // User may not retain the slice returned by Data since the underlying
 // memory chunk may be reused.
-func (req *RecvReq) Data() (data []byte) {
-	sh := (*reflect.SliceHeader)(unsafe.Pointer(&data))
-	sh.Data = uintptr(req.pkt_addr)
-	sh.Len = int(req.length)
-	sh.Cap = int(req.length_data)
-	return
+func (req *RecvReq) Data() []byte {
+	data := req.DataFull()
+	return data[:req.length:req.length]
+}
+
+// DataFull is similar to Data but the capacity of the returned slice
+// spans the whole slot occupied by the packet in the data ring, which
+// may be larger than the packet itself. Bytes beyond the length of
+// the slice are not part of the packet and may be uninitialized.
+//
+// User may not retain the slice returned by DataFull since the
+// underlying memory chunk may be reused.
+func (req *RecvReq) DataFull() []byte {
+	data := array2Slice(req.pkt_addr, int(req.length_data))
+	return data[:req.length]
+}
+
+// setData makes req describe a packet of length bytes occupying
+// data as its data ring slot.
+func (req *RecvReq) setData(data []byte, length int) {
+	req.pkt_addr = unsafe.Pointer(&data[0])
+	req.length = C.uint32_t(length)
+	req.length_data = C.uint32_t(len(data))
 }
 
 // Timestamp returns 64-bit timestamp in nanoseconds.
@@ -172,22 +262,84 @@ func dur2ms(d time.Duration) C.int {
 	// a desired wait time in milliseconds. With a non-zero wait
 	// time, the function only blocks if there are no outstanding
 	// packets.
-	if ms := int(d.Nanoseconds() / 1000000); ms > 0 {
-		return C.int(ms)
-	}
+	ms := int32(d.Nanoseconds() / 1000000)
 
 	// "If the value is 0, the function is guaranteed to never
 	// enter a blocking state and returns EAGAIN unless there is a packet
 	// waiting."
 	// Author commentary: During heavy workload, timeout 0 may cause
 	// other applications working on the same port to experience EINVAL
-	// error. So timeout 0 will be reset to 1ms.
-	return 1
+	// error. So timeout 0 will be reset to 1ms by default.
+	if floor := atomic.LoadInt32(&minTimeoutMs); ms < floor {
+		return C.int(floor)
+	}
+	return C.int(ms)
+}
+
+// minimum timeout in milliseconds applied by dur2ms
+var minTimeoutMs int32 = 1
+
+// SetMinPollInterval sets the minimum non-negative timeout passed to
+// SNF on receiving and injecting packets. By default, it is 1ms so
+// timeouts less than 1ms are rounded up to 1ms (see RoundTimeout).
+// Since SNF timeouts are in milliseconds, d is truncated to
+// milliseconds, so d less than 1ms removes the floor and zero
+// timeouts are passed to SNF as is. Negative d is treated as 0.
+//
+// WARNING: during heavy workload, zero timeout may cause other
+// applications working on the same port to experience EINVAL error.
+// Only remove the floor for benchmarking or if the application is
+// the only one working on the port.
+//
+// The setting applies to timeouts specified after the call, i.e.
+// RingReaders and Senders already created are not affected.
+func SetMinPollInterval(d time.Duration) {
+	ms := int32(d / time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+	atomic.StoreInt32(&minTimeoutMs, ms)
+}
+
+// RoundTimeout returns the timeout which is effectively passed to
+// SNF when d is specified as a receive or injection timeout. SNF only
+// supports timeouts in milliseconds, so:
+//
+// Negative d means blocking indefinitely and -1ms is returned.
+//
+// Positive d is truncated to milliseconds. If the result is less than
+// the minimum set with SetMinPollInterval(), which is 1ms by default,
+// the minimum is returned since zero timeout may cause other
+// applications working on the same port to experience EINVAL error.
+// Use Ring's RecvNonBlocking() or ReaderOptNonBlocking option if zero
+// timeout is required.
+func RoundTimeout(d time.Duration) time.Duration {
+	return time.Duration(dur2ms(d)) * time.Millisecond
 }
 
+var (
+	initOnce sync.Once
+	initErr  error
+	initDone uint32
+)
+
 // Init initializes the sniffer library.
+//
+// Only the first call initializes the library, subsequent calls
+// return the result of the first one.
 func Init() error {
-	return retErr(C.snf_init(C.SNF_VERSION_API))
+	initOnce.Do(func() {
+		if initErr = retErr(C.snf_init(C.SNF_VERSION_API)); initErr == nil {
+			atomic.StoreUint32(&initDone, 1)
+		}
+	})
+	return initErr
+}
+
+// Initialized reports whether the sniffer library was successfully
+// initialized with Init().
+func Initialized() bool {
+	return atomic.LoadUint32(&initDone) > 0
 }
 
 // SetAppID sets the application ID.
@@ -213,7 +365,62 @@ func Init() error {
 // valid ID is any value except -1 which is reserved and represents
 // "no ID".
 //
-// EINVAL is returned if Init() has not been called or id is -1.
+// If id is -1, an error wrapping EINVAL is returned without calling
+// SNF. EINVAL is also returned if Init() has not been called.
+//
+// SetAppID is serialized with OpenHandle() so the ID can't be changed
+// while a handle is being opened.
 func SetAppID(id int32) error {
-	return retErr(C.snf_set_app_id(C.int(id)))
+	openMtx.Lock()
+	defer openMtx.Unlock()
+	return setAppID(id)
+}
+
+func setAppID(id int32) error {
+	if id == -1 {
+		return fmt.Errorf("application ID -1 is reserved: %w", syscall.EINVAL)
+	}
+
+	err := retErr(C.snf_set_app_id(C.int(id)))
+	if err == nil {
+		atomic.StoreInt32(&appID, id)
+	}
+	return err
+}
+
+// last application ID set with SetAppID
+var appID int32 = -1
+
+// AppID returns effective application ID. If SNF_APP_ID environment
+// variable is set to a valid integer, its value is returned since it
+// overrides the ID set via SetAppID(). Otherwise, the last ID
+// successfully set with SetAppID() is returned, or -1 if none was set.
+//
+// This may be used to detect the misconfiguration where a mix of
+// processes with valid application IDs and processes with no IDs
+// (-1) is run.
+func AppID() int32 {
+	if s, ok := os.LookupEnv("SNF_APP_ID"); ok {
+		if id, err := strconv.ParseInt(s, 10, 32); err == nil {
+			return int32(id)
+		}
+	}
+	return atomic.LoadInt32(&appID)
+}
+
+// Length returns captured length of the packet in bytes. SNF doesn't
+// report the original length of the packet on the wire separately,
+// so there is no way to tell if the packet was truncated by SNF.
+//
+// Note that struct snf_recv_req carries no per-packet flags or
+// status bits reported by the NIC. Bad CRC/PHY frames are only
+// accounted for in NicPktBad field of RingStats.
+func (req *RecvReq) Length() int {
+	return int(req.length)
+}
+
+// LengthData returns length of the slot occupied by the packet in
+// the data ring, which may be larger than the captured length.
+func (req *RecvReq) LengthData() int {
+	return int(req.length_data)
 }
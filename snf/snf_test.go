@@ -8,6 +8,7 @@ package snf_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -19,6 +20,8 @@ import (
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/yerden/go-snf/snf"
 )
 
@@ -62,6 +65,10 @@ func TestInit(t *testing.T) {
 	defer teardown(t)
 
 	assertFail(err == nil)
+	assertFail(snf.Initialized())
+
+	// repeated Init is a no-op
+	assertFail(snf.Init() == nil)
 }
 
 func TestGetIfAddrs(t *testing.T) {
@@ -119,12 +126,14 @@ func TestHandleRing(t *testing.T) {
 
 	_, err = h.OpenRing()
 	assert(err == syscall.EBUSY)
+	assert(len(h.Rings()) == 2)
 
 	// attempt to close: fail, 2 to go
 	assert(err == syscall.EBUSY)
 
 	// close 0
 	assert(r0.Close() == nil)
+	assert(len(h.Rings()) == 1 && h.Rings()[0] == r1)
 
 	// attempt to close: fail, 1 to go
 	assert(h.Close() == syscall.EBUSY)
@@ -134,6 +143,205 @@ func TestHandleRing(t *testing.T) {
 
 	// attempt to close: ok
 	assert(h.Close() == nil)
+	assert(!h.IsStarted())
+}
+
+func TestDoubleClose(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	teardown, err := setup(t)
+	defer teardown(t)
+	assertFail(err == nil)
+
+	ifa, err := snf.GetIfAddrs()
+	assertFail(err == nil && len(ifa) > 0)
+
+	portnum := ifa[0].PortNum()
+	h, err := snf.OpenHandle(portnum)
+	assertFail(err == nil)
+
+	r, err := h.OpenRing()
+	assertFail(err == nil)
+
+	inj, err := snf.OpenInjectHandle(int(portnum))
+	assertFail(err == nil)
+
+	assert(inj.Close() == nil)
+	assert(inj.Close() == nil)
+
+	assert(r.Close() == nil)
+	assert(r.Close() == nil)
+
+	assert(h.Close() == nil)
+	assert(h.Close() == nil)
+}
+
+func TestDuplex(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	teardown, err := setup(t)
+	defer teardown(t)
+	assertFail(err == nil)
+
+	ifa, err := snf.GetIfAddrs()
+	assertFail(err == nil && len(ifa) > 0)
+
+	h, inj, err := snf.OpenDuplex(ifa[0].PortNum())
+	assertFail(err == nil)
+
+	r, err := h.OpenRing()
+	assert(err == nil)
+	assert(r != nil)
+
+	assert(h.Start() == nil)
+	s := snf.NewSender(inj, time.Second, 0)
+	assert(s.Send(make([]byte, snf.MinPacketSize)) == nil)
+
+	assert(snf.CloseDuplex(h, inj) == nil)
+	assert(len(h.Rings()) == 0)
+}
+
+func TestRingReaderClosed(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	teardown, err := setup(t)
+	defer teardown(t)
+	assertFail(err == nil)
+
+	ifa, err := snf.GetIfAddrs()
+	assertFail(err == nil && len(ifa) > 0)
+
+	h, err := snf.OpenHandle(ifa[0].PortNum())
+	assertFail(err == nil)
+	defer h.Close()
+
+	r, err := h.OpenRing()
+	assertFail(err == nil)
+
+	rcv := snf.NewReader(r, time.Millisecond, 256)
+	assert(!h.IsStarted())
+	assertFail(h.Start() == nil)
+	assert(h.IsStarted())
+
+	// redundant calls are no-ops
+	assert(h.Start() == nil)
+	assert(h.IsStarted())
+
+	// stop the reader before closing the ring since closing must
+	// not race with receiving
+	ch := make(chan os.Signal, 1)
+	rcv.NotifyWith(ch)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ch <- syscall.SIGUSR1
+		close(ch)
+	}()
+
+	for rcv.LoopNext() {
+	}
+
+	_, ok := rcv.Err().(*snf.ErrSignal)
+	assert(ok, rcv.Err())
+	assert(rcv.Free() == nil)
+
+	// ring is closed underneath the stopped reader
+	assert(r.Close() == nil)
+	assert(!rcv.Next())
+	assert(rcv.Err() == io.EOF, rcv.Err())
+	assert(rcv.Free() == nil)
+}
+
+func TestRingReaderFreeAfterError(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	teardown, err := setup(t)
+	defer teardown(t)
+	assertFail(err == nil)
+
+	ifa, err := snf.GetIfAddrs()
+	assertFail(err == nil && len(ifa) > 0)
+
+	h, err := snf.OpenHandle(ifa[0].PortNum())
+	assertFail(err == nil)
+	defer h.Close()
+
+	r, err := h.OpenRing()
+	assertFail(err == nil)
+	defer r.Close()
+
+	// handle is not started so receiving times out
+	rcv := snf.NewReader(r, time.Millisecond, 256)
+	assert(!rcv.Next())
+	assert(rcv.Err() == syscall.EAGAIN, rcv.Err())
+	_, buffered := rcv.BurstBytes()
+	assert(buffered == 0)
+
+	// nothing is borrowed so nothing is returned
+	assert(rcv.Free() == nil)
+	assert(rcv.Free() == nil)
+
+	qinfo, err := r.QInfo()
+	assert(err == nil)
+	assert(qinfo.Borrowed() == 0)
+}
+
+func TestRingReaderAgainThenData(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	teardown, err := setup(t)
+	defer teardown(t)
+	assertFail(err == nil)
+
+	ifa, err := snf.GetIfAddrs()
+	assertFail(err == nil && len(ifa) > 0)
+
+	h, err := snf.OpenHandle(ifa[0].PortNum())
+	assertFail(err == nil)
+	defer h.Close()
+
+	r, err := h.OpenRing()
+	assertFail(err == nil)
+	defer r.Close()
+
+	const burst = 4
+	rcv := snf.NewReader(r, time.Millisecond, burst)
+	defer rcv.Free()
+
+	// handle is not started so a number of empty bursts time out
+	for i := 0; i < 3; i++ {
+		assert(!rcv.Next())
+		assert(rcv.Err() == syscall.EAGAIN, rcv.Err())
+		_, buffered := rcv.BurstBytes()
+		assert(buffered == 0)
+	}
+
+	// packets are received after the empty bursts, up to burst at once
+	assertFail(h.Start() == nil)
+	dst := make([][]byte, burst)
+	total, deadline := 0, time.Now().Add(time.Second)
+	for total < 16*burst && time.Now().Before(deadline) {
+		n, err := rcv.ReadBurst(dst)
+		if err == syscall.EAGAIN {
+			continue
+		}
+		assertFail(err == nil, err)
+		assert(n > 0 && n <= burst, n)
+		total += n
+	}
+
+	if total == 0 {
+		t.Skip("no traffic on port", ifa[0].PortNum())
+	}
+
+	assert(rcv.Free() == nil)
+	qinfo, err := r.QInfo()
+	assert(err == nil)
+	assert(qinfo.Borrowed() == 0)
 }
 
 func TestApp(t *testing.T) {
@@ -336,3 +544,379 @@ func ExampleRingReader() {
 		handlePacket(ci, data)
 	}
 }
+
+func TestSenderPacketSize(t *testing.T) {
+	assert := newAssert(t, false)
+
+	// packet size is validated before calling SNF so no handle is
+	// needed
+	s := snf.NewSender(nil, time.Second, 0)
+	for _, n := range []int{0, snf.MaxPacketSize + 1} {
+		err, ok := s.Send(make([]byte, n)).(*snf.ErrPacketSize)
+		assert(ok && err.Len == n, n)
+		err, ok = s.SendVec(make([]byte, n/2), make([]byte, n-n/2)).(*snf.ErrPacketSize)
+		assert(ok && err.Len == n, n)
+	}
+
+	// empty packets are rejected in bulk before sending anything
+	sent, bulkErr := s.SendBulk([][]byte{make([]byte, 60), {}})
+	sizeErr, isSize := bulkErr.(*snf.ErrPacketSize)
+	assert(sent == 0 && isSize && sizeErr.Len == 0, sent, bulkErr)
+	sent, bulkErr = s.SendBulk(nil)
+	assert(sent == 0 && bulkErr == nil, sent, bulkErr)
+
+	frags := make([][]byte, snf.MaxFragments+1)
+	for i := range frags {
+		frags[i] = make([]byte, 1)
+	}
+	empty := gopacket.NewPacket(nil, layers.LinkTypeEthernet, gopacket.Default)
+	_, ok := s.SendPacket(empty).(*snf.ErrPacketSize)
+	assert(ok)
+
+	err, ok := s.SendVec(frags...).(*snf.ErrFragments)
+	assert(ok && err.Count == len(frags))
+	err, ok = s.SchedVec(0, frags...).(*snf.ErrFragments)
+	assert(ok && err.Count == len(frags))
+
+	s = snf.NewSenderWithFrags(nil, time.Second, 0, 0)
+	err, ok = s.SendVec(frags...).(*snf.ErrFragments)
+	assert(ok && err.Count == len(frags))
+
+	ss := snf.NewSyncSenderWithFrags(nil, time.Second, 0, 0)
+	err, ok = ss.SendVec(frags...).(*snf.ErrFragments)
+	assert(ok && err.Count == len(frags))
+	_, ok = ss.SendPacket(empty).(*snf.ErrPacketSize)
+	assert(ok)
+}
+
+func TestSenderStream(t *testing.T) {
+	assert := newAssert(t, false)
+
+	// stream is checked before calling SNF so no handle is needed
+	s := snf.NewSender(nil, time.Second, 0)
+
+	n, err := s.SendStream(bytes.NewReader(nil))
+	assert(n == 0 && err == nil, n, err)
+
+	n, err = s.SendStream(bytes.NewReader([]byte{0, 10, 1, 2, 3}))
+	assert(n == 0 && err == io.ErrUnexpectedEOF, n, err)
+
+	n, err = s.SendStream(bytes.NewReader([]byte{0, 0}))
+	e, ok := err.(*snf.ErrPacketSize)
+	assert(n == 0 && ok && e.Len == 0, n, err)
+}
+
+func TestInjectPoolEmpty(t *testing.T) {
+	assert := newAssert(t, false)
+
+	p, err := snf.NewInjectPool()
+	assert(p == nil && err == syscall.EINVAL, err)
+}
+
+func BenchmarkRingReader(b *testing.B) {
+	if err := snf.Init(); err != nil {
+		b.Skip("unable to init SNF:", err)
+	}
+
+	h, err := snf.OpenHandle(0)
+	if err != nil {
+		b.Skip("unable to open handle:", err)
+	}
+	defer h.Close()
+
+	r, err := h.OpenRing()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+
+	rcv := snf.NewReader(r, time.Second, 256)
+	defer rcv.Free()
+
+	if err := h.Start(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !rcv.LoopNext() {
+			b.Fatal(rcv.Err())
+		}
+	}
+}
+
+func BenchmarkZeroCopyReadPacketData(b *testing.B) {
+	if err := snf.Init(); err != nil {
+		b.Skip("unable to init SNF:", err)
+	}
+
+	h, err := snf.OpenHandle(0)
+	if err != nil {
+		b.Skip("unable to open handle:", err)
+	}
+	defer h.Close()
+
+	r, err := h.OpenRing()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+
+	rcv := snf.NewReader(r, time.Second, 256)
+	defer rcv.Free()
+
+	if err := h.Start(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := rcv.ZeroCopyReadPacketData()
+		for err == syscall.EAGAIN {
+			_, _, err = rcv.ZeroCopyReadPacketData()
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAppID(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	teardown, err := setup(t)
+	defer teardown(t)
+
+	assertFail(err == nil)
+
+	// original value is restored on cleanup
+	t.Setenv("SNF_APP_ID", "")
+	assertFail(os.Unsetenv("SNF_APP_ID") == nil)
+
+	err = snf.SetAppID(-1)
+	assert(errors.Is(err, syscall.EINVAL), err)
+
+	err = snf.SetAppID(32)
+	assert(err == nil, err)
+	assert(snf.AppID() == 32, snf.AppID())
+
+	// environment overrides
+	t.Setenv("SNF_APP_ID", "33")
+	assert(snf.AppID() == 33, snf.AppID())
+}
+
+func TestFileRing(t *testing.T) {
+	assertFail := newAssert(t, true)
+	assert := newAssert(t, false)
+
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	assertFail(w.WriteFileHeader(65536, layers.LinkTypeEthernet) == nil)
+
+	ts := time.Unix(1500000000, 12345000)
+	pkts := [][]byte{
+		bytes.Repeat([]byte{1}, 60),
+		bytes.Repeat([]byte{2}, 100),
+	}
+	for i, pkt := range pkts {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(pkt),
+			Length:        len(pkt),
+		}
+		assertFail(w.WritePacket(ci, pkt) == nil)
+	}
+
+	// read twice with looping enabled
+	fr, err := snf.NewFileRing(bytes.NewReader(buf.Bytes()), true)
+	assertFail(err == nil, err)
+	for i := 0; i < 2*len(pkts); i++ {
+		assertFail(fr.Next(), fr.Err())
+		n := i % len(pkts)
+		req := fr.RecvReq()
+		assert(bytes.Equal(req.Data(), pkts[n]))
+		assert(req.Timestamp() == ts.Add(time.Duration(n)*time.Second).UnixNano())
+	}
+
+	// without looping, io.EOF is returned
+	fr, err = snf.NewFileRing(bytes.NewReader(buf.Bytes()), false)
+	assertFail(err == nil, err)
+	for range pkts {
+		assert(fr.Next())
+	}
+	assert(!fr.Next() && fr.Err() == io.EOF, fr.Err())
+}
+
+func TestPortMaskOf(t *testing.T) {
+	assert := newAssert(t, false)
+
+	assert(snf.PortMaskOf() == 0)
+	assert(snf.PortMaskOf(0) == 1)
+	assert(snf.PortMaskOf(0, 2, 2) == 5)
+	assert(snf.PortMaskOf(31) == 1<<31)
+	assert(snf.PortMaskOf(1, 32) == 2)
+}
+
+func TestFlagString(t *testing.T) {
+	assert := newAssert(t, false)
+
+	assert((snf.PShared | snf.RxDuplicate).String() == "PShared|RxDuplicate")
+	assert(snf.Flag(0).String() == "0")
+	assert(snf.Flag(-1).String() == "Default")
+	assert((snf.RssIP | snf.RssSrcPort).String() == "RssIP|RssSrcPort")
+	assert((snf.RssGre | 0x1000).String() == "RssGre|0x1000")
+}
+
+func TestRoundTimeout(t *testing.T) {
+	assert := newAssert(t, false)
+
+	for d, rounded := range map[time.Duration]time.Duration{
+		-time.Second:                  -time.Millisecond,
+		0:                             time.Millisecond,
+		500 * time.Microsecond:        time.Millisecond,
+		time.Millisecond:              time.Millisecond,
+		1900 * time.Microsecond:       time.Millisecond,
+		time.Second + time.Nanosecond: time.Second,
+	} {
+		assert(snf.RoundTimeout(d) == rounded, d)
+	}
+
+	snf.SetMinPollInterval(0)
+	assert(snf.RoundTimeout(500*time.Microsecond) == 0)
+	assert(snf.RoundTimeout(-time.Second) == -time.Millisecond)
+	snf.SetMinPollInterval(time.Millisecond)
+	assert(snf.RoundTimeout(0) == time.Millisecond)
+}
+
+func TestReflectNil(t *testing.T) {
+	assert := newAssert(t, false)
+
+	var ref *snf.ReflectHandle
+	assert(ref.Reflect(make([]byte, 64)) == syscall.EINVAL)
+}
+
+func TestDataRingSizeOption(t *testing.T) {
+	assert := newAssert(t, false)
+
+	// options are validated before calling SNF
+	for _, opt := range []snf.HandlerOption{
+		snf.HandlerOptDataRingMB(0),
+		snf.HandlerOptDataRingMB(-1),
+		snf.HandlerOptDataRingMB(1 << 20),
+		snf.HandlerOptDataRingBytes(1000000),
+		snf.HandlerOptDataRingBytes(snf.MaxDataRingBytes + 1),
+	} {
+		h, err := snf.OpenHandle(0, opt)
+		assert(h == nil && errors.Is(err, syscall.EINVAL), err)
+	}
+}
+
+func TestStatsSamplerInterval(t *testing.T) {
+	assert := newAssert(t, false)
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		ch, cancel, err := snf.NewStatsSampler(nil, d)
+		assert(ch == nil && cancel == nil && errors.Is(err, syscall.EINVAL), err)
+	}
+}
+
+func TestDropsNotStarted(t *testing.T) {
+	assert := newAssert(t, false)
+
+	// baseline is only captured by Start()
+	var h snf.Handle
+	n, err := h.DropsSinceStart()
+	assert(n == 0 && errors.Is(err, syscall.EINVAL), n, err)
+}
+
+func TestDemuxPortNum(t *testing.T) {
+	assert := newAssert(t, false)
+
+	d := snf.NewDemux(nil)
+	fn := func(*snf.RecvReq) error { return nil }
+	for _, portnum := range []int{-1, 32} {
+		err := d.Handle(portnum, fn)
+		assert(errors.Is(err, syscall.EINVAL), portnum, err)
+	}
+	assert(d.Handle(0, fn) == nil)
+	assert(d.Handle(31, fn) == nil)
+}
+
+func TestReturnExactlyUntracked(t *testing.T) {
+	assert := newAssert(t, false)
+
+	// tracking is opt-in
+	var r snf.Ring
+	err := r.ReturnExactly(nil, nil)
+	assert(errors.Is(err, syscall.EINVAL), err)
+
+	r.TrackBorrowed(true)
+	assert(r.ReturnExactly(nil, nil) == nil)
+}
+
+func TestRecvReqData(t *testing.T) {
+	assert := newAssert(t, false)
+
+	// packet occupies a larger slot in the data ring
+	slot := make([]byte, 128)
+	var req snf.RecvReq
+	snf.SetRecvReqData(&req, slot, 100)
+
+	data := req.Data()
+	assert(len(data) == 100 && cap(data) == 100, len(data), cap(data))
+	assert(&data[0] == &slot[0])
+
+	full := req.DataFull()
+	assert(len(full) == 100 && cap(full) == 128, len(full), cap(full))
+	assert(&full[0] == &slot[0])
+}
+
+func TestFlowChecker(t *testing.T) {
+	assert := newAssert(t, false)
+
+	pkt := func(srcPort layers.TCPPort) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    []byte{10, 0, 0, 1},
+			DstIP:    []byte{10, 0, 0, 2},
+		}
+		tcp := &layers.TCP{SrcPort: srcPort, DstPort: 80}
+		tcp.SetNetworkLayerForChecksum(ip)
+		err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{
+				SrcMAC:       make([]byte, 6),
+				DstMAC:       make([]byte, 6),
+				EthernetType: layers.EthernetTypeIPv4,
+			}, ip, tcp)
+		assert(err == nil, err)
+		return buf.Bytes()
+	}
+
+	fc := snf.NewFlowChecker()
+	fc.Add(0, pkt(1000))
+	fc.Add(0, pkt(1000))
+	fc.Add(1, pkt(2000))
+	assert(len(fc.Split()) == 0)
+
+	fc.Add(1, pkt(1000))
+	split := fc.Split()
+	assert(len(split) == 1)
+	assert(split[0].Flow.Transport.Src().String() == "1000")
+	assert(len(split[0].Rings) == 2)
+}
+
+func TestVersion(t *testing.T) {
+	assert := newAssert(t, false)
+
+	major, minor := snf.VersionMajor(), snf.VersionMinor()
+	assert(snf.Version == uint16(major)<<8|uint16(minor))
+	assert(snf.VersionString() == fmt.Sprintf("%d.%d", major, minor))
+	assert(snf.CheckVersionAtLeast(major, minor))
+	assert(snf.CheckVersionAtLeast(0, 0))
+	assert(!snf.CheckVersionAtLeast(major+1, 0))
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which
+// can be found in the LICENSE file in the root of the source
+// tree.
+
+package snf
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RingStatsRate is the rate of RingStats counters of a ring measured
+// over a sampling interval. All rates are per second.
+type RingStatsRate struct {
+	// Ring is the sampled ring.
+	Ring *Ring
+	// Interval is the actual time elapsed since the previous sample.
+	Interval time.Duration
+	// Err is the error returned by ring's Stats(). If not nil, rates
+	// are zero.
+	Err error
+
+	NicPktRecv      float64
+	NicPktOverflow  float64
+	NicPktBad       float64
+	RingPktRecv     float64
+	RingPktOverflow float64
+	NicBytesRecv    float64
+	SnfPktOverflow  float64
+	NicPktDropped   float64
+}
+
+// if a counter decreased, it was reset so it is counted from zero
+func counterRate(prev, cur uint64, sec float64) float64 {
+	if cur < prev {
+		return float64(cur) / sec
+	}
+	return float64(cur-prev) / sec
+}
+
+func (rate *RingStatsRate) fill(prev, cur *RingStats, d time.Duration) {
+	sec := d.Seconds()
+	rate.Interval = d
+	rate.NicPktRecv = counterRate(prev.NicPktRecv, cur.NicPktRecv, sec)
+	rate.NicPktOverflow = counterRate(prev.NicPktOverflow, cur.NicPktOverflow, sec)
+	rate.NicPktBad = counterRate(prev.NicPktBad, cur.NicPktBad, sec)
+	rate.RingPktRecv = counterRate(prev.RingPktRecv, cur.RingPktRecv, sec)
+	rate.RingPktOverflow = counterRate(prev.RingPktOverflow, cur.RingPktOverflow, sec)
+	rate.NicBytesRecv = counterRate(prev.NicBytesRecv, cur.NicBytesRecv, sec)
+	rate.SnfPktOverflow = counterRate(prev.SnfPktOverflow, cur.SnfPktOverflow, sec)
+	rate.NicPktDropped = counterRate(prev.NicPktDropped, cur.NicPktDropped, sec)
+}
+
+// NewStatsSampler starts a goroutine which calls Stats() for each of
+// the rings every interval and sends their rates over the returned
+// channel, one RingStatsRate per ring in the same order. If a counter
+// decreases between samples, it is considered to be reset and is
+// counted from zero.
+//
+// Rates of a ring are zero in the first sample after its Stats()
+// failed since there is nothing to compare against. If the channel
+// isn't read in time, sampling is delayed accordingly but the rates
+// remain correct as they are measured over the actual time elapsed.
+//
+// The returned function stops the sampler and closes the channel. It
+// is safe to call it more than once.
+//
+// If interval is not positive, an error wrapping EINVAL is returned
+// and no sampler is started.
+func NewStatsSampler(rings []*Ring, interval time.Duration) (<-chan []RingStatsRate, func(), error) {
+	if interval <= 0 {
+		return nil, nil, fmt.Errorf("invalid sampling interval %v: %w", interval, syscall.EINVAL)
+	}
+
+	ch := make(chan []RingStatsRate, 1)
+	done := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(done) })
+	}
+
+	go func() {
+		defer close(ch)
+
+		prev := make([]*RingStats, len(rings))
+		for i, r := range rings {
+			if stats, err := r.Stats(); err == nil {
+				prev[i] = stats
+			}
+		}
+		last := time.Now()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+
+			now := time.Now()
+			rates := make([]RingStatsRate, len(rings))
+			for i, r := range rings {
+				rates[i].Ring = r
+				stats, err := r.Stats()
+				if rates[i].Err = err; err != nil {
+					prev[i] = nil
+					continue
+				}
+
+				if prev[i] != nil {
+					rates[i].fill(prev[i], stats, now.Sub(last))
+				}
+				prev[i] = stats
+			}
+			last = now
+
+			select {
+			case <-done:
+				return
+			case ch <- rates:
+			}
+		}
+	}()
+
+	return ch, cancel, nil
+}
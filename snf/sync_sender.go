@@ -0,0 +1,146 @@
+// Copyright 2019 Yerden Zhumabekov. All rights reserved.
+//
+// Use of this source code is governed by MIT license which can be
+// found in the LICENSE file in the root of the source tree.
+
+package snf
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SyncSender is a Sender which is safe for concurrent use by
+// multiple goroutines. Sending methods are serialized with a mutex so
+// prefer Sender if only one goroutine sends packets.
+type SyncSender struct {
+	mtx sync.Mutex
+	s   *Sender
+}
+
+// NewSyncSender returns new SyncSender object with given timeout and
+// flags for SNF injection. See NewSender for details.
+func NewSyncSender(h *InjectHandle, timeout time.Duration, flags int) *SyncSender {
+	return &SyncSender{s: NewSender(h, timeout, flags)}
+}
+
+// NewSyncSenderWithFrags is the same as NewSyncSender but the
+// fragment buffer is preallocated for maxFrags fragments. See
+// NewSenderWithFrags for details.
+func NewSyncSenderWithFrags(h *InjectHandle, timeout time.Duration, flags int, maxFrags int) *SyncSender {
+	return &SyncSender{s: NewSenderWithFrags(h, timeout, flags, maxFrags)}
+}
+
+// NotifyWith installs signal notification channel which is presumably
+// registered via signal.Notify.
+func (ss *SyncSender) NotifyWith(ch <-chan os.Signal) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ss.s.NotifyWith(ch)
+}
+
+// PadTo is the same as Sender's PadTo().
+func (ss *SyncSender) PadTo(minLen int) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ss.s.PadTo(minLen)
+}
+
+// Send is the same as Sender's Send().
+func (ss *SyncSender) Send(pkt []byte) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.Send(pkt)
+}
+
+// SendRetry is the same as Sender's SendRetry(). The mutex is not
+// held while sleeping between attempts.
+func (ss *SyncSender) SendRetry(pkt []byte, attempts int, backoff time.Duration) (err error) {
+	for i := 0; i < attempts || i == 0; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+		}
+		if err = ss.Send(pkt); err != syscall.EAGAIN {
+			break
+		}
+	}
+	return err
+}
+
+// SendStream is the same as Sender's SendStream(). The mutex is held
+// until the whole stream is sent.
+func (ss *SyncSender) SendStream(r io.Reader) (int, error) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.SendStream(r)
+}
+
+// SendBulk is the same as Sender's SendBulk().
+func (ss *SyncSender) SendBulk(pkts [][]byte) (int, error) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.SendBulk(pkts)
+}
+
+// SendVec is the same as Sender's SendVec().
+func (ss *SyncSender) SendVec(pkt ...[]byte) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.SendVec(pkt...)
+}
+
+// Sched is the same as Sender's Sched().
+func (ss *SyncSender) Sched(delayNs int64, pkt []byte) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.Sched(delayNs, pkt)
+}
+
+// SchedVec is the same as Sender's SchedVec().
+func (ss *SyncSender) SchedVec(delayNs int64, pkt ...[]byte) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.SchedVec(delayNs, pkt...)
+}
+
+// SchedAfter is the same as Sender's SchedAfter().
+func (ss *SyncSender) SchedAfter(delay time.Duration, pkt []byte) error {
+	return ss.Sched(delay2ns(delay), pkt)
+}
+
+// SchedVecAfter is the same as Sender's SchedVecAfter().
+func (ss *SyncSender) SchedVecAfter(delay time.Duration, pkt ...[]byte) error {
+	return ss.SchedVec(delay2ns(delay), pkt...)
+}
+
+// SchedBatch is the same as Sender's SchedBatch(). The mutex is held
+// until the whole schedule is injected.
+func (ss *SyncSender) SchedBatch(schedule []ScheduledPacket) (int, error) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.SchedBatch(schedule)
+}
+
+// GetStats is the same as InjectHandle's GetStats().
+func (ss *SyncSender) GetStats() (*InjectStats, error) {
+	return ss.s.GetStats()
+}
+
+// Close waits for sends in progress to complete and closes the
+// injection handle. See InjectHandle's Close().
+func (ss *SyncSender) Close() error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.Close()
+}
+
+// CloseWithTimeout is the same as Close() but it gives up waiting
+// for pending sends after d. See InjectHandle's CloseWithTimeout().
+func (ss *SyncSender) CloseWithTimeout(d time.Duration) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.s.CloseWithTimeout(d)
+}